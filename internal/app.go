@@ -83,12 +83,14 @@ func Init(ctx context.Context, opts ...Option) (func(), error) {
 	}
 	InitHttpClient()
 	return func() {
-		loggerCleanFunc()
+		// Flush the metrics first, their errors are logged
 		influxdbCleanFunc()
+		loggerCleanFunc()
 	}, nil
 }
 
-// 启动服务
+// 启动服务, the listeners stop accepting once ctx is done. The returned func waits for the
+// proxied connections to drain and flushes the metrics and logs, it is called after ctx is done.
 func InitServer(ctx context.Context, opts ...Option) (func(), error) {
 	initCleanFunc, err := Init(ctx, opts...)
 	if err != nil {
@@ -98,18 +100,28 @@ func InitServer(ctx context.Context, opts ...Option) (func(), error) {
 	if err != nil {
 		return nil, err
 	}
+	drain := func(ctx context.Context) {}
 	switch basicConf.Type {
 	case initer.TypeClient:
 		//serverCleanFunc = bll.NewClient().Listen(ctx, attr)
 		fmt.Println("########## start the client proxy #########")
 	case initer.TypeServer:
-		bll.NewServer().Listen(ctx, attr)
+		server := bll.NewServer()
+		if err = server.Listen(ctx, attr); err != nil {
+			return nil, err
+		}
+		drain = server.Drain
 		fmt.Println("########## start the server proxy #########")
 	case initer.TypeRelay:
 		fmt.Println("########## start the relay proxy #########")
-		bll.NewRelay().Listen(ctx, attr)
+		relay := bll.NewRelay()
+		if err = relay.Listen(ctx, attr); err != nil {
+			return nil, err
+		}
+		drain = relay.Drain
 	}
 	return func() {
+		drain(ctx)
 		initCleanFunc()
 	}, nil
 }
@@ -144,6 +156,11 @@ func InitInfluxdb(ctx context.Context) (func(), error) {
 	}, iconfig)
 	config.Is.Metrics = metrics
 	return func() {
+		if metrics != nil {
+			if err := metrics.Flush(); err != nil {
+				logger.WithContext(ctx).Errorf("Failed to flush the metrics: %v", err)
+			}
+		}
 		client.Close()
 	}, err
 }
@@ -164,10 +181,17 @@ func Run(ctx context.Context, opts ...Option) error {
 	state := 1
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	cleanFunc, err := InitServer(ctx, opts...)
+	if upgradeSignal != nil {
+		signal.Notify(sc, upgradeSignal)
+	}
+	serveCtx, stopServing := context.WithCancel(ctx)
+	defer stopServing()
+	cleanFunc, err := InitServer(serveCtx, opts...)
 	if err != nil {
 		return err
 	}
+	// Started by the upgrade of a previous binary, which may drain now that the listeners took over its sockets
+	notifyUpgradeReady()
 
 EXIT:
 	for {
@@ -178,14 +202,43 @@ EXIT:
 			state = 0
 			break EXIT
 		case syscall.SIGHUP:
+		case upgradeSignal:
+			// The new binary accepts on the same sockets, this one drains
+			if err := upgrade(ctx); err != nil {
+				logger.WithErrorStack(ctx, err).Errorf("Upgrade failed, still serving: %v", err)
+				continue
+			}
+			state = 0
+			break EXIT
 		default:
 			break EXIT
 		}
 	}
 
-	cleanFunc()
+	stopServing()
+	Shutdown(ctx, sc, cleanFunc)
 	logger.WithContext(ctx).Infof("shutdown!")
-	time.Sleep(time.Second)
 	os.Exit(state)
 	return nil
 }
+
+// Shutdown Run cleanFunc, which drains the connections, until it returns or another signal arrives on sc
+func Shutdown(ctx context.Context, sc <-chan os.Signal, cleanFunc func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cleanFunc()
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case sig := <-sc:
+			if sig == syscall.SIGHUP || sig == upgradeSignal {
+				continue
+			}
+			logger.WithContext(ctx).Warnf("received signal[%s] while draining, shutting down now", sig.String())
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"net"
+	"runtime"
+	"sync"
+)
+
+// acceptors Sockets per listener of a relay or server
+func acceptors() int {
+	if config.C.Accept.Acceptors > 1 {
+		return config.C.Accept.Acceptors
+	}
+	return 1
+}
+
+// HandshakeFunc Run the handshake of an accepted connection, handing the connection to its own goroutine
+// once it completed or closing it
+type HandshakeFunc func(conn net.Conn)
+
+// HandshakePool Fixed workers running the TLS handshakes of the connections a relay or server accepted,
+// so that a burst of handshakes cannot starve the proxied connections. The accept loops wait while the
+// queue is full, the connections then wait in the backlog of the listening sockets.
+// The workers live as long as the ctx of the pool, the connections still queued then are closed.
+type HandshakePool struct {
+	ctx   context.Context
+	tasks chan handshakeTask
+
+	// mu Held by the dispatches while queueing, closed set once the queue is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+type handshakeTask struct {
+	conn      net.Conn
+	handshake HandshakeFunc
+}
+
+// NewHandshakePool Start the workers of a pool that ends with ctx
+func NewHandshakePool(ctx context.Context) *HandshakePool {
+	workers := config.C.Accept.HandshakeWorkers
+	if workers <= 0 {
+		workers = 16 * runtime.NumCPU()
+	}
+	queue := config.C.Accept.HandshakeQueue
+	if queue <= 0 {
+		queue = workers
+	}
+	a := &HandshakePool{ctx: ctx, tasks: make(chan handshakeTask, queue)}
+	for i := 0; i < workers; i++ {
+		go a.work()
+	}
+	go a.close()
+	return a
+}
+
+// Dispatch Queue the handshake of conn, waiting for room in the queue. conn is closed when the pool ends first.
+func (a *HandshakePool) Dispatch(conn net.Conn, handshake HandshakeFunc) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		_ = conn.Close()
+		return
+	}
+	select {
+	case a.tasks <- handshakeTask{conn: conn, handshake: handshake}:
+	case <-a.ctx.Done():
+		_ = conn.Close()
+	}
+}
+
+// close Close the queue once ctx is done and the dispatches in flight gave up
+func (a *HandshakePool) close() {
+	<-a.ctx.Done()
+	a.mu.Lock()
+	a.closed = true
+	close(a.tasks)
+	a.mu.Unlock()
+}
+
+// work Run the queued handshakes until the queue is closed, those left once ctx is done are dropped
+func (a *HandshakePool) work() {
+	for task := range a.tasks {
+		if a.ctx.Err() != nil {
+			_ = task.conn.Close()
+			continue
+		}
+		a.run(task)
+	}
+}
+
+// run A panic only ends the task, the worker goes on
+func (a *HandshakePool) run(task handshakeTask) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.WithContext(a.ctx).Errorf("[panic] in a handshake worker: %v", err)
+		}
+	}()
+	task.handshake(task.conn)
+}
@@ -0,0 +1,251 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/pkg/certificate"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setTestCertificate Issue a CA and a certificate for both ends of the mTLS handshakes as [Certificate],
+// a relay of uuid "test". restore puts the previous one back
+func setTestCertificate(tb testing.TB) (restore func()) {
+	previous := config.C.Certificate
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtraExtensions: []pkix.Extension{{
+			Id:    certificate.AttrOID,
+			Value: []byte(`{"attrs":{"type":"relay","uuid":"test"}}`),
+		}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	config.C.Certificate.CaPem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+	config.C.Certificate.CertPem = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	config.C.Certificate.KeyPem = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return func() {
+		config.C.Certificate = previous
+	}
+}
+
+func TestHandshakePoolRecovers(t *testing.T) {
+	defer func(accept config.Accept) { config.C.Accept = accept }(config.C.Accept)
+	config.C.Accept = config.Accept{HandshakeWorkers: 1, HandshakeQueue: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewHandshakePool(ctx)
+	done := make(chan struct{})
+	local, remote := net.Pipe()
+	defer remote.Close()
+	pool.Dispatch(local, func(conn net.Conn) {
+		panic("handshake")
+	})
+	// The only worker survived the panic
+	pool.Dispatch(local, func(conn net.Conn) {
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the worker did not survive a panicking handshake")
+	}
+}
+
+func TestHandshakePoolClosesOnDone(t *testing.T) {
+	defer func(accept config.Accept) { config.C.Accept = accept }(config.C.Accept)
+	config.C.Accept = config.Accept{HandshakeWorkers: 1, HandshakeQueue: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewHandshakePool(ctx)
+	block := make(chan struct{})
+	ran := make(chan struct{}, 3)
+	wait := func(conn net.Conn) {
+		ran <- struct{}{}
+		<-block
+	}
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		conns = append(conns, local)
+	}
+	pool.Dispatch(conns[0], wait)
+	<-ran
+	pool.Dispatch(conns[1], wait)
+	// Worker and queue are taken, the next dispatch waits until ctx is done and closes the connection
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	pool.Dispatch(conns[2], wait)
+	if _, err := conns[2].Write([]byte{1}); err == nil {
+		t.Error("the connection left waiting was not closed")
+	}
+	// The queued connection is closed rather than handshaked once the worker is free
+	close(block)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := conns[1].Write([]byte{1}); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the queued connection was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(ran) != 0 {
+		t.Error("a handshake ran after the pool ended")
+	}
+	// Nothing is queued any more
+	local, remote := net.Pipe()
+	defer remote.Close()
+	pool.Dispatch(local, wait)
+	if _, err := local.Write([]byte{1}); err == nil {
+		t.Error("a connection dispatched to an ended pool was not closed")
+	}
+}
+
+// BenchmarkAcceptHandshake Connections per second through listenPeers up to a completed mTLS handshake,
+// with a goroutine per connection or the handshake pool, and one or several SO_REUSEPORT acceptors.
+// The clients dial from the same process, run with -cpu to compare core counts.
+func BenchmarkAcceptHandshake(b *testing.B) {
+	defer setTestCertificate(b)()
+	defer func(accept config.Accept, items []config.Listener) {
+		config.C.Accept, config.C.Listeners = accept, items
+	}(config.C.Accept, config.C.Listeners)
+	for _, bench := range []struct {
+		name      string
+		acceptors int
+		pool      bool
+	}{
+		{"goroutine/acceptors=1", 1, false},
+		{"pool/acceptors=1", 1, true},
+		{"pool/acceptors=4", 4, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			benchmarkAcceptHandshake(b, bench.acceptors, bench.pool)
+		})
+	}
+}
+
+func benchmarkAcceptHandshake(b *testing.B, acceptors int, usePool bool) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	_ = probe.Close()
+	config.C.Accept = config.Accept{Acceptors: acceptors}
+	config.C.Listeners = []config.Listener{{Network: "tcp", Address: addr}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handshake := func(conn net.Conn) {
+		if _, err := peerCertificate(conn); err == nil {
+			_, _ = conn.Write([]byte{1})
+		}
+		_ = conn.Close()
+	}
+	pool := NewHandshakePool(ctx)
+	dispatch := func(conn net.Conn) {
+		if usePool {
+			pool.Dispatch(conn, handshake)
+			return
+		}
+		go handshake(conn)
+	}
+	if err = listenPeers(ctx, "Benchmark", 0, dispatch); err != nil {
+		b.Fatal(err)
+	}
+	clientConfig, err := DialTLSConfig()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var failed error
+	b.SetParallelism(8)
+	b.ReportAllocs()
+	b.ResetTimer()
+	begin := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		reply := make([]byte, 1)
+		for pb.Next() {
+			err := func() error {
+				conn, err := tls.Dial("tcp", addr, clientConfig)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				if _, err = conn.Read(reply); err != nil {
+					return err
+				}
+				return nil
+			}()
+			if err != nil {
+				mu.Lock()
+				failed = err
+				mu.Unlock()
+			}
+		}
+	})
+	b.StopTimer()
+	if failed != nil {
+		b.Fatalf("dial %s: %v", addr, failed)
+	}
+	b.ReportMetric(float64(b.N)/time.Since(begin).Seconds(), "conns/s")
+}
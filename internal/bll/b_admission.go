@@ -0,0 +1,170 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdmissionError A connection refused by the admission control, Status is the HTTP status sent to the peer
+type AdmissionError struct {
+	Status int
+	Reason string
+}
+
+func (e *AdmissionError) Error() string {
+	return e.Reason
+}
+
+// AdmissionController Limits on the connections accepted by a relay or server, globally and per peer.
+// The TLS handshakes in flight are limited per source IP, the connections per peer certificate identity.
+type AdmissionController struct {
+	mu             sync.Mutex
+	handshakes     int
+	handshakesByIP map[string]int
+	conns          int
+	connsByID      map[string]int
+	rate           *tokenBucket
+	rateByID       map[string]*tokenBucket
+	rateSwept      time.Time
+}
+
+func NewAdmissionController() *AdmissionController {
+	return &AdmissionController{
+		handshakesByIP: make(map[string]int),
+		connsByID:      make(map[string]int),
+		rateByID:       make(map[string]*tokenBucket),
+	}
+}
+
+// Handshake Admit the TLS handshake of a connection from addr, release is called once it is done
+func (a *AdmissionController) Handshake(addr net.Addr) (func(), error) {
+	limits := config.C.Admission
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if limits.MaxHandshakes > 0 && a.handshakes >= limits.MaxHandshakes {
+		return nil, &AdmissionError{Status: http.StatusServiceUnavailable, Reason: fmt.Sprintf("Too many TLS handshakes in flight (%d)", a.handshakes)}
+	}
+	if limits.MaxHandshakesPerIP > 0 && a.handshakesByIP[ip] >= limits.MaxHandshakesPerIP {
+		return nil, &AdmissionError{Status: http.StatusServiceUnavailable, Reason: fmt.Sprintf("Too many TLS handshakes in flight from %s (%d)", ip, a.handshakesByIP[ip])}
+	}
+	a.handshakes++
+	a.handshakesByIP[ip]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.handshakes--
+			if a.handshakesByIP[ip]--; a.handshakesByIP[ip] <= 0 {
+				delete(a.handshakesByIP, ip)
+			}
+		})
+	}, nil
+}
+
+// Admit Admit a connection of the peer identity, release is called once it ends
+func (a *AdmissionController) Admit(identity string) (func(), error) {
+	limits := config.C.Admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if limits.MaxConns > 0 && a.conns >= limits.MaxConns {
+		return nil, &AdmissionError{Status: http.StatusServiceUnavailable, Reason: fmt.Sprintf("Too many connections (%d)", a.conns)}
+	}
+	if limits.MaxConnsPerIdentity > 0 && a.connsByID[identity] >= limits.MaxConnsPerIdentity {
+		return nil, &AdmissionError{Status: http.StatusServiceUnavailable, Reason: fmt.Sprintf("Too many connections of %s (%d)", identity, a.connsByID[identity])}
+	}
+	if limits.ConnRate > 0 {
+		if a.rate == nil {
+			a.rate = newRateBucket(limits.ConnRate)
+		}
+		if !a.rate.allow(int64(limits.ConnRate)) {
+			return nil, &AdmissionError{Status: http.StatusTooManyRequests, Reason: fmt.Sprintf("More than %d new connections per second", limits.ConnRate)}
+		}
+	}
+	a.sweepRates(limits.ConnRatePerIdentity)
+	if limits.ConnRatePerIdentity > 0 {
+		bucket, ok := a.rateByID[identity]
+		if !ok {
+			bucket = newRateBucket(limits.ConnRatePerIdentity)
+			a.rateByID[identity] = bucket
+		}
+		if !bucket.allow(int64(limits.ConnRatePerIdentity)) {
+			return nil, &AdmissionError{Status: http.StatusTooManyRequests, Reason: fmt.Sprintf("More than %d new connections per second of %s", limits.ConnRatePerIdentity, identity)}
+		}
+	}
+	a.conns++
+	a.connsByID[identity]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.conns--
+			if a.connsByID[identity]--; a.connsByID[identity] <= 0 {
+				delete(a.connsByID, identity)
+			}
+		})
+	}, nil
+}
+
+// sweepRates Forget the rate buckets of the identities that refilled them, at most once a second. All are
+// forgotten once the rate per identity is unlimited.
+func (a *AdmissionController) sweepRates(rate int) {
+	if rate <= 0 {
+		if len(a.rateByID) > 0 {
+			a.rateByID = make(map[string]*tokenBucket)
+		}
+		return
+	}
+	now := time.Now()
+	if now.Sub(a.rateSwept) < time.Second {
+		return
+	}
+	a.rateSwept = now
+	for identity, bucket := range a.rateByID {
+		if bucket.full(now) {
+			delete(a.rateByID, identity)
+		}
+	}
+}
+
+func newRateBucket(rate int) *tokenBucket {
+	return &tokenBucket{rate: int64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// peerIdentity The uuid issued to the peer certificate, its common name when it carries none
+func peerIdentity(peer *x509.Certificate) string {
+	if attrs, err := peerAttrs(peer); err == nil {
+		if uuid, ok := attrs["uuid"].(string); ok && uuid != "" {
+			return uuid
+		}
+	}
+	return peer.Subject.CommonName
+}
+
+// rejectConn Answer the request of a refused peer with the reason, the connection is closed afterwards
+func rejectConn(w io.Writer, err *AdmissionError) {
+	_, _ = fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nX-Reject-Reason: %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		err.Status, http.StatusText(err.Status), err.Reason, len(err.Reason), err.Reason)
+}
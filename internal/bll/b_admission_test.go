@@ -0,0 +1,143 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/initer"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/websocket"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdmitRatePerIdentity(t *testing.T) {
+	defer func(admission config.Admission) { config.C.Admission = admission }(config.C.Admission)
+	config.C.Admission = config.Admission{ConnRatePerIdentity: 2}
+	a := NewAdmissionController()
+	for i := 0; i < 2; i++ {
+		release, err := a.Admit("client")
+		if err != nil {
+			t.Fatalf("Admit %d: %v", i, err)
+		}
+		release()
+	}
+	if _, err := a.Admit("client"); err == nil {
+		t.Fatal("Admit beyond the rate succeeded")
+	}
+	if _, err := a.Admit("other"); err != nil {
+		t.Fatalf("Admit of another identity: %v", err)
+	}
+}
+
+func TestAdmitForgetsIdleRates(t *testing.T) {
+	defer func(admission config.Admission) { config.C.Admission = admission }(config.C.Admission)
+	config.C.Admission = config.Admission{ConnRatePerIdentity: 10}
+	a := NewAdmissionController()
+	for i := 0; i < 100; i++ {
+		release, err := a.Admit("client-" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	// Refilled buckets are forgotten by the next sweep
+	idle := time.Now().Add(-2 * time.Second)
+	for _, bucket := range a.rateByID {
+		bucket.last = idle
+	}
+	a.rateByID["client-0"].tokens = -100
+	a.rateSwept = time.Time{}
+	if _, err := a.Admit("client-100"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.rateByID["client-0"]; !ok {
+		t.Error("a bucket still refilling was forgotten")
+	}
+	if len(a.rateByID) != 2 {
+		t.Errorf("%d rate buckets kept, want 2", len(a.rateByID))
+	}
+
+	config.C.Admission.ConnRatePerIdentity = 0
+	if _, err := a.Admit("client-0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.rateByID) != 0 {
+		t.Errorf("%d rate buckets kept without a rate per identity", len(a.rateByID))
+	}
+}
+
+// upgradeStatus Send the websocket request of client through relay to the server and return the status of the answer
+func upgradeStatus(t *testing.T, server *Server, relay *x509.Certificate, relayPem, clientPem string) int {
+	local, remote := net.Pipe()
+	defer local.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.serveConn(context.Background(), &schema.ServerConfig{UUID: "server"}, remote, relay)
+		_ = remote.Close()
+	}()
+	req, _ := http.NewRequest(http.MethodGet, "/secretLink", nil)
+	if _, err := websocket.SetRequestHeaders(req); err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Chains", `{"uuid":"client"}`)
+	req.Header.Set("X-RelayCert", base64.StdEncoding.EncodeToString([]byte(relayPem)))
+	req.Header.Set("X-ClientCert", base64.StdEncoding.EncodeToString([]byte(clientPem)))
+	go func() {
+		_ = req.Write(local)
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(local), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = local.Close()
+	<-done
+	return resp.StatusCode
+}
+
+func TestAdmitRelayedClients(t *testing.T) {
+	defer func(admission config.Admission) { config.C.Admission = admission }(config.C.Admission)
+	defer func(certificate config.Certificate) { config.C.Certificate = certificate }(config.C.Certificate)
+	ca := newTestCA(t)
+	config.C.Certificate.CaPem = ca.pem
+	config.C.Admission = config.Admission{MaxConnsPerIdentity: 1}
+	relay, relayPem := ca.issue(t, map[string]interface{}{"type": initer.TypeRelay, "uuid": "relay"})
+	client := func(uuid string) string {
+		_, certPem := ca.issue(t, map[string]interface{}{
+			"type":   initer.TypeClient,
+			"uuid":   uuid,
+			"server": map[string]interface{}{"uuid": "server", "host": "127.0.0.1", "port": 443},
+		})
+		return certPem
+	}
+	server := NewServer()
+	// A connection of the busy client is in flight, the other client behind the same relay is still admitted
+	release, err := server.admission.Admit("busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if status := upgradeStatus(t, server, relay, relayPem, client("busy")); status != http.StatusServiceUnavailable {
+		t.Errorf("the busy client got %d", status)
+	}
+	if status := upgradeStatus(t, server, relay, relayPem, client("other")); status != http.StatusSwitchingProtocols {
+		t.Errorf("the other client behind the relay got %d", status)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthFunc Check that a server can be reached
+type HealthFunc func(next *schema.NextServer) error
+
+// HealthChangeFunc Called when a server becomes healthy or unhealthy, err is the failed check
+type HealthChangeFunc func(next *schema.NextServer, healthy bool, err error)
+
+// balanceMember A server of a group
+type balanceMember struct {
+	next     *schema.NextServer
+	priority int
+	active   int64
+	healthy  int32
+}
+
+func (a *balanceMember) isHealthy() bool {
+	return atomic.LoadInt32(&a.healthy) == 1
+}
+
+// ServerBalancer Pick a healthy server of a group per connection according to the group policy
+type ServerBalancer struct {
+	policy   string
+	members  []*balanceMember
+	counter  uint32
+	onChange HealthChangeFunc
+}
+
+// NewServerBalancer onChange is called when a member becomes healthy or unhealthy, it may be nil
+func NewServerBalancer(group *schema.ServerGroup, onChange HealthChangeFunc) *ServerBalancer {
+	balancer := &ServerBalancer{policy: group.Policy, onChange: onChange}
+	for _, item := range group.Servers {
+		balancer.members = append(balancer.members, &balanceMember{
+			next: &schema.NextServer{
+				UUID: item.UUID,
+				Host: item.Host,
+				Port: strconv.Itoa(item.OutPort),
+			},
+			priority: item.Priority,
+			healthy:  1,
+		})
+	}
+	return balancer
+}
+
+// Pick Choose a server, prefer is kept when it is a healthy member.
+// When no member is healthy all are candidates.
+func (a *ServerBalancer) Pick(prefer string) *schema.NextServer {
+	return a.pick(prefer, nil)
+}
+
+// Failover Mark the member failed down after err and pick a member not in tried, nil when all were tried
+func (a *ServerBalancer) Failover(failed string, err error, tried map[string]bool) *schema.NextServer {
+	a.Down(failed, err)
+	tried[failed] = true
+	return a.pick("", tried)
+}
+
+func (a *ServerBalancer) pick(prefer string, tried map[string]bool) *schema.NextServer {
+	var members, candidates []*balanceMember
+	for _, member := range a.members {
+		if tried[member.next.UUID] {
+			continue
+		}
+		members = append(members, member)
+		if member.isHealthy() {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = members
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	for _, member := range candidates {
+		if prefer != "" && member.next.UUID == prefer {
+			return member.next
+		}
+	}
+	picked := candidates[0]
+	switch a.policy {
+	case schema.PolicyPriority:
+		for _, member := range candidates[1:] {
+			if member.priority < picked.priority {
+				picked = member
+			}
+		}
+	case schema.PolicyLeastConn:
+		for _, member := range candidates[1:] {
+			if atomic.LoadInt64(&member.active) < atomic.LoadInt64(&picked.active) {
+				picked = member
+			}
+		}
+	default:
+		picked = candidates[int(atomic.AddUint32(&a.counter, 1)-1)%len(candidates)]
+	}
+	return picked.next
+}
+
+// Acquire Count a connection to the member uuid until the returned release is called
+func (a *ServerBalancer) Acquire(uuid string) func() {
+	for _, member := range a.members {
+		if member.next.UUID == uuid {
+			atomic.AddInt64(&member.active, 1)
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					atomic.AddInt64(&member.active, -1)
+				})
+			}
+		}
+	}
+	return func() {}
+}
+
+// Down Mark the member uuid unhealthy after a failed connection, until a health check succeeds.
+// Reports whether it was healthy.
+func (a *ServerBalancer) Down(uuid string, err error) bool {
+	for _, member := range a.members {
+		if member.next.UUID == uuid {
+			if !atomic.CompareAndSwapInt32(&member.healthy, 1, 0) {
+				return false
+			}
+			if a.onChange != nil {
+				a.onChange(member.next, false, err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Run Check the members until ctx is done
+func (a *ServerBalancer) Run(ctx context.Context, check HealthFunc) {
+	interval := time.Duration(config.C.HealthCheck.Interval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, member := range a.members {
+			wg.Add(1)
+			go func(member *balanceMember) {
+				defer wg.Done()
+				err := check(member.next)
+				healthy := int32(0)
+				if err == nil {
+					healthy = 1
+				}
+				if atomic.SwapInt32(&member.healthy, healthy) != healthy && a.onChange != nil {
+					a.onChange(member.next, err == nil, err)
+				}
+			}(member)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// releaseConn A connection counted by a balancer until it is closed
+type releaseConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *releaseConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *releaseConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// healthTimeout Time a health check may take
+func healthTimeout() time.Duration {
+	if config.C.HealthCheck.Timeout > 0 {
+		return time.Duration(config.C.HealthCheck.Timeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// balancerIdleTimeout Time the balancer of a group without tunnels keeps checking it before it is dropped
+const balancerIdleTimeout = 5 * time.Minute
+
+// maxBalancers Groups balanced at once, the tunnels to further groups go to the member the client picked
+const maxBalancers = 1024
+
+// BalancerSet Balancers of the server groups by serverGroupKey. A balancer checks its group while it has
+// tunnels and for balancerIdleTimeout after the last one ended, it is then dropped.
+type BalancerSet struct {
+	mu      sync.Mutex
+	entries map[string]*balancerEntry
+}
+
+type balancerEntry struct {
+	balancer *ServerBalancer
+	cancel   context.CancelFunc
+	tunnels  int
+	idle     *time.Timer
+}
+
+func NewBalancerSet() *BalancerSet {
+	return &BalancerSet{entries: make(map[string]*balancerEntry)}
+}
+
+// Acquire The balancer of group for a tunnel until release is called. A new balancer is built by create and
+// checks its members with check until dropped or ctx is done. nil when maxBalancers groups are balanced.
+func (a *BalancerSet) Acquire(ctx context.Context, group *schema.ServerGroup, create func() *ServerBalancer, check HealthFunc) (*ServerBalancer, func()) {
+	key := serverGroupKey(group)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.entries[key]
+	if !ok {
+		if len(a.entries) >= maxBalancers {
+			return nil, func() {}
+		}
+		runCtx, cancel := context.WithCancel(ctx)
+		entry = &balancerEntry{balancer: create(), cancel: cancel}
+		a.entries[key] = entry
+		go entry.balancer.Run(runCtx, check)
+	}
+	if entry.idle != nil {
+		entry.idle.Stop()
+		entry.idle = nil
+	}
+	entry.tunnels++
+	var once sync.Once
+	return entry.balancer, func() {
+		once.Do(func() {
+			a.release(key, entry)
+		})
+	}
+}
+
+func (a *BalancerSet) release(key string, entry *balancerEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry.tunnels--
+	if entry.tunnels > 0 {
+		return
+	}
+	entry.idle = time.AfterFunc(balancerIdleTimeout, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		// Acquired again while the timer fired
+		if entry.tunnels > 0 || a.entries[key] != entry {
+			return
+		}
+		delete(a.entries, key)
+		entry.cancel()
+	})
+}
+
+// serverGroupKey Identify a group by its members
+func serverGroupKey(group *schema.ServerGroup) string {
+	keys := make([]string, 0, len(group.Servers)+1)
+	keys = append(keys, group.Policy)
+	for _, item := range group.Servers {
+		keys = append(keys, item.UUID+"@"+net.JoinHostPort(item.Host, strconv.Itoa(item.OutPort)))
+	}
+	return strings.Join(keys, "/")
+}
@@ -0,0 +1,399 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/initer"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/certificate"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// challengeSize Size of the random challenge the server sends the client
+const challengeSize = 32
+
+// ListenTLSConfig mTLS configuration of the relay and server listeners, peers must present a certificate issued by the CA
+func ListenTLSConfig() (*tls.Config, error) {
+	cert, err := tls.X509KeyPair([]byte(config.C.Certificate.CertPem), []byte(config.C.Certificate.KeyPem))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(config.C.Certificate.CaPem)) {
+		return nil, errors.NewWithStack("failed to parse the CA certificate")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}, nil
+}
+
+// listenerTLSConfig TLS configuration of a relay or server listener, the one of ListenTLSConfig with the
+// certificate, CA and lowest version of the listener
+func listenerTLSConfig(listener config.Listener) (*tls.Config, error) {
+	tlsConfig, err := ListenTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if listener.CertPemPath != "" || listener.KeyPemPath != "" {
+		cert, err := tls.LoadX509KeyPair(listener.CertPemPath, listener.KeyPemPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load the certificate of the listener %s", listener.Address)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if listener.CaPemPath != "" {
+		caPem, err := ioutil.ReadFile(listener.CaPemPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load the CA of the listener %s", listener.Address)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, errors.NewWithStack("failed to parse the CA certificate of the listener " + listener.Address)
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	switch listener.MinVersion {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, errors.NewWithStack("unknown TLS version of the listener " + listener.Address + ": " + listener.MinVersion)
+	}
+	return tlsConfig, nil
+}
+
+// DialTLSConfig TLS configuration of outgoing tunnel connections, presenting our own certificate
+func DialTLSConfig() (*tls.Config, error) {
+	cert, err := tls.X509KeyPair([]byte(config.C.Certificate.CertPem), []byte(config.C.Certificate.KeyPem))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}, nil
+}
+
+// headerPem Decode the base64 PEM certificate carried in a request header
+func headerPem(req *http.Request, name string) (string, error) {
+	value := req.Header.Get(name)
+	if value == "" {
+		return "", errors.NewWithStack(name + " argument is missing")
+	}
+	certPem, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(certPem), nil
+}
+
+// headerCert Decode the certificate carried in a request header and verify it against the CA
+func headerCert(req *http.Request, name string) (string, error) {
+	certPem, err := headerPem(req, name)
+	if err != nil {
+		return "", err
+	}
+	err = certificate.NewVerify(certPem, config.C.Certificate.CaPem, "").Verify()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return certPem, nil
+}
+
+// tlsHandshaker The server side of a TLS connection, *tls.Conn or proxyTLSConn
+type tlsHandshaker interface {
+	net.Conn
+	Handshake() error
+	ConnectionState() tls.ConnectionState
+}
+
+// peerCertificate Complete the TLS handshake of an accepted connection within tlsHandshakeTimeout and return the certificate of the peer
+func peerCertificate(conn net.Conn) (*x509.Certificate, error) {
+	tlsConn, ok := conn.(tlsHandshaker)
+	if !ok {
+		return nil, errors.NewWithStack("the previous hop is not a TLS connection")
+	}
+	_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout()))
+	err := tlsConn.Handshake()
+	_ = tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.NewWithStack("the previous hop presented no certificate")
+	}
+	return state.PeerCertificates[0], nil
+}
+
+// peerAttrs Read the controller issued attributes of a peer certificate
+func peerAttrs(cert *x509.Certificate) (map[string]interface{}, error) {
+	attrs, err := certificate.New().GetAttributesFromCert(cert)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if attrs.Attrs == nil {
+		return nil, errors.NewWithStack("the peer certificate carries no attributes")
+	}
+	return attrs.Attrs, nil
+}
+
+// verifyHopCert Check that the previous hop announced the certificate it authenticated with over mTLS and
+// return the verified client certificate. A relay announces its own certificate in X-RelayCert and vouches
+// for the client it forwards, any other peer must be the client of X-ClientCert itself.
+func verifyHopCert(peer *x509.Certificate, req *http.Request) (*x509.Certificate, error) {
+	client, err := headerCertificate(req, "X-ClientCert")
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("X-RelayCert") != "" {
+		relay, err := headerCertificate(req, "X-RelayCert")
+		if err != nil {
+			return nil, err
+		}
+		if relay.Equal(peer) {
+			if attrs, err := peerAttrs(peer); err == nil && attrs["type"] == initer.TypeRelay {
+				return client, nil
+			}
+		}
+	}
+	if !client.Equal(peer) {
+		return nil, errors.NewWithStack("X-ClientCert does not match the TLS peer certificate, only relays forward other clients")
+	}
+	return client, nil
+}
+
+// headerCertificate Parse the certificate carried in a request header
+func headerCertificate(req *http.Request, name string) (*x509.Certificate, error) {
+	certPem, err := headerPem(req, name)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := certificate.ParseCertificate(certPem)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cert, nil
+}
+
+// challengeClient Send a random challenge through the tunnel and verify that the client signed it with the
+// private key of certPem. Relays forward it untouched, so the client proves key possession end to end.
+func challengeClient(conn net.Conn, certPem string) error {
+	cert, err := certificate.ParseCertificate(certPem)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	challenge, err := certificate.NewChallenge(challengeSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = conn.Write(challenge); err != nil {
+		return errors.WithStack(err)
+	}
+	var size [2]byte
+	if _, err = io.ReadFull(conn, size[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	signature := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err = io.ReadFull(conn, signature); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(certificate.VerifyChallenge(cert, challenge, signature))
+}
+
+// answerChallenge Sign the challenge sent by the server with our private key
+func answerChallenge(conn net.Conn) error {
+	cert, err := tls.X509KeyPair([]byte(config.C.Certificate.CertPem), []byte(config.C.Certificate.KeyPem))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.NewWithStack("the private key cannot sign")
+	}
+	challenge := make([]byte, challengeSize)
+	if _, err = io.ReadFull(conn, challenge); err != nil {
+		return errors.WithStack(err)
+	}
+	signature, err := certificate.SignChallenge(signer, challenge)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	msg := make([]byte, 2, 2+len(signature))
+	binary.BigEndian.PutUint16(msg, uint16(len(signature)))
+	msg = append(msg, signature...)
+	_, err = conn.Write(msg)
+	return errors.WithStack(err)
+}
+
+// clientGrant Read the client configuration issued by the controller from a verified client certificate
+func clientGrant(certPem string) (*schema.ClientConfig, error) {
+	cert, err := certificate.ParseCertificate(certPem)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	attrs, err := certificate.New().GetAttributesFromCert(cert)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	grant, err := schema.ParseClientConfig(attrs.Attrs)
+	if err != nil {
+		return nil, err
+	}
+	if grant.Type != initer.TypeClient {
+		return nil, errors.NewWithStack("not a client certificate: " + grant.Type)
+	}
+	return grant, nil
+}
+
+// VerifyPeer Build a VerifyPeerCertificate callback accepting only CA issued certificates carrying the uuid
+// attribute, and when fingerprint is set only the certificate with that hex SHA-256 fingerprint
+func VerifyPeer(uuid, fingerprint string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return verifyPeer(func(attrs map[string]interface{}, raw []byte) error {
+		if attrs["uuid"] != uuid {
+			return errors.NewWithStack("the peer certificate does not belong to " + uuid)
+		}
+		return checkFingerprint(raw, fingerprint)
+	})
+}
+
+// VerifyPeerServers Build a VerifyPeerCertificate callback accepting the certificate of any of servers,
+// each pinned to its fingerprint when set
+func VerifyPeerServers(servers []schema.Server) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return verifyPeer(func(attrs map[string]interface{}, raw []byte) error {
+		for _, item := range servers {
+			if attrs["uuid"] == item.UUID {
+				return checkFingerprint(raw, item.Fingerprint)
+			}
+		}
+		return errors.NewWithStack("the peer certificate does not belong to any server of the group")
+	})
+}
+
+// VerifyPeerType Build a VerifyPeerCertificate callback accepting any CA issued certificate of a sentinel type
+func VerifyPeerType(sentinelType string) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return verifyPeer(func(attrs map[string]interface{}, _ []byte) error {
+		if attrs["type"] != sentinelType {
+			return errors.NewWithStack("the peer certificate is not of type " + sentinelType)
+		}
+		return nil
+	})
+}
+
+// checkFingerprint Compare the hex SHA-256 fingerprint of a raw certificate, anything matches an empty fingerprint
+func checkFingerprint(raw []byte, fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+	sum := sha256.Sum256(raw)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), fingerprint) {
+		return errors.NewWithStack("the peer certificate does not match the pinned fingerprint")
+	}
+	return nil
+}
+
+func verifyPeer(check func(attrs map[string]interface{}, raw []byte) error) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.NewWithStack("the peer presented no certificate")
+		}
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			certs = append(certs, cert)
+		}
+		opts := x509.VerifyOptions{
+			Roots:         x509.NewCertPool(),
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		if !opts.Roots.AppendCertsFromPEM([]byte(config.C.Certificate.CaPem)) {
+			return errors.NewWithStack("failed to parse the CA certificate")
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return errors.WithStack(err)
+		}
+		attrs, err := peerAttrs(certs[0])
+		if err != nil {
+			return err
+		}
+		return check(attrs, rawCerts[0])
+	}
+}
+
+// InnerDialTLSConfig TLS configuration of the end-to-end session from the client to the server,
+// pinned to the server issued by the controller, or to the members of its server group as the
+// last relay may pick another member
+func InnerDialTLSConfig(conf *schema.ClientConfig) (*tls.Config, error) {
+	tlsConfig, err := DialTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.VerifyPeerCertificate = VerifyPeerServers(conf.ServerMembers())
+	return tlsConfig, nil
+}
+
+// innerClient Start the end-to-end TLS session with the server over the relayed tunnel
+func innerClient(conn net.Conn, conf *schema.ClientConfig) (net.Conn, error) {
+	tlsConfig, err := InnerDialTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return tlsConn, nil
+}
+
+// innerServer Accept the end-to-end TLS session of the client, which must authenticate with certPem
+func innerServer(conn net.Conn, certPem string) (net.Conn, error) {
+	tlsConfig, err := ListenTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, tlsConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cert, err := certificate.ParseCertificate(certPem)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !cert.Equal(tlsConn.ConnectionState().PeerCertificates[0]) {
+		return nil, errors.NewWithStack("X-ClientCert does not match the end-to-end TLS peer certificate")
+	}
+	return tlsConn, nil
+}
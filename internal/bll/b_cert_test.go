@@ -0,0 +1,180 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/initer"
+	"github.com/ztalab/ZASentinel/pkg/certificate"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testCA A CA issuing the sentinel certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue A certificate carrying the sentinel attributes, with its PEM
+func (ca *testCA) issue(t *testing.T, attrs map[string]interface{}) (*x509.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: fmt.Sprint(attrs["uuid"])},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	ext, err := certificate.New().ToPkixExtension(&certificate.Attributes{Attrs: attrs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.ExtraExtensions = []pkix.Extension{ext}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// testSentinelCert A certificate of a sentinel of type with uuid, with its PEM
+func testSentinelCert(t *testing.T, sentinelType, uuid string) (*x509.Certificate, string) {
+	return newTestCA(t).issue(t, map[string]interface{}{"type": sentinelType, "uuid": uuid})
+}
+
+func TestVerifyHopCert(t *testing.T) {
+	client, clientPem := testSentinelCert(t, initer.TypeClient, "client")
+	_, victimPem := testSentinelCert(t, initer.TypeClient, "victim")
+	relay, relayPem := testSentinelCert(t, initer.TypeRelay, "relay")
+	server, serverPem := testSentinelCert(t, initer.TypeServer, "server")
+	tests := []struct {
+		name      string
+		peer      *x509.Certificate
+		relayCert string
+		client    string
+		ok        bool
+	}{
+		{"client", client, "", clientPem, true},
+		{"client announcing itself as relay", client, clientPem, clientPem, true},
+		{"relay forwarding a client", relay, relayPem, victimPem, true},
+		{"client without a certificate", client, "", "", false},
+		{"client with the certificate of another", client, "", victimPem, false},
+		{"client forging X-RelayCert", client, clientPem, victimPem, false},
+		{"client announcing a relay", client, relayPem, victimPem, false},
+		{"server announcing itself as relay", server, serverPem, victimPem, false},
+		{"relay not announcing itself", relay, "", victimPem, false},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/secretLink", nil)
+		if tt.relayCert != "" {
+			req.Header.Set("X-RelayCert", base64.StdEncoding.EncodeToString([]byte(tt.relayCert)))
+		}
+		if tt.client != "" {
+			req.Header.Set("X-ClientCert", base64.StdEncoding.EncodeToString([]byte(tt.client)))
+		}
+		client, err := verifyHopCert(tt.peer, req)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if err == nil && string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Raw})) != tt.client {
+			t.Errorf("%s: verified %s as the client", tt.name, client.Subject.CommonName)
+		}
+	}
+}
+
+func TestChallengeClient(t *testing.T) {
+	defer setTestCertificate(t)()
+	_, otherPem := testSentinelCert(t, initer.TypeClient, "other")
+	for _, tt := range []struct {
+		name    string
+		certPem string
+		ok      bool
+	}{
+		{"own key", config.C.Certificate.CertPem, true},
+		{"key of another certificate", otherPem, false},
+	} {
+		server, client := net.Pipe()
+		answered := make(chan error, 1)
+		go func() {
+			answered <- answerChallenge(client)
+		}()
+		if err := challengeClient(server, tt.certPem); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err := <-answered; err != nil {
+			t.Errorf("%s: answering %v", tt.name, err)
+		}
+		_ = server.Close()
+		_ = client.Close()
+	}
+
+	// Anything but a signature over the challenge is refused
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		challenge := make([]byte, challengeSize)
+		if _, err := io.ReadFull(client, challenge); err != nil {
+			return
+		}
+		_, _ = client.Write([]byte{0, 4, 1, 2, 3, 4})
+	}()
+	if err := challengeClient(server, config.C.Certificate.CertPem); err == nil {
+		t.Error("a signature not over the challenge was accepted")
+	}
+}
@@ -16,170 +16,511 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
-	"github.com/xtaci/smux"
+	"fmt"
 	"github.com/ztalab/ZASentinel/internal/config"
 	"github.com/ztalab/ZASentinel/internal/contextx"
 	"github.com/ztalab/ZASentinel/internal/event"
 	"github.com/ztalab/ZASentinel/internal/metrics"
 	"github.com/ztalab/ZASentinel/internal/schema"
-	"github.com/ztalab/ZASentinel/pkg/certificate"
 	"github.com/ztalab/ZASentinel/pkg/errors"
 	"github.com/ztalab/ZASentinel/pkg/logger"
 	"github.com/ztalab/ZASentinel/pkg/pconst"
 	"github.com/ztalab/ZASentinel/pkg/recover"
 	"github.com/ztalab/ZASentinel/pkg/util/trace"
+	"github.com/ztalab/ZASentinel/pkg/websocket"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-type Client struct{}
+type Client struct {
+	sessions *SessionPool
+	// dns Synthetic addresses of the DNS responder, nil when it is disabled
+	dns *fakeDNS
+	// paths Ranking of the relays and the server, nil until Listen
+	paths *PathSelector
+	// balancer Picks the member of the server group, nil without a group
+	balancer *ServerBalancer
+	drainer  *Drainer
+}
 
 func NewClient() *Client {
-	return &Client{}
+	return &Client{
+		sessions: NewSessionPool(sessionEnded),
+		drainer:  NewDrainer(),
+	}
 }
 
-func (a *Client) DialWS(ctx context.Context, nextAddr *schema.NextServer, conf *schema.ClientConfig) (net.Conn, error) {
-	conn, err := tls.Dial("tcp", nextAddr.Host+":"+nextAddr.Port, &tls.Config{
-		InsecureSkipVerify: true,
-	})
+// sessionEnded Log why the tunnel to a next hop ended, the next connection dials it again
+func sessionEnded(key string, err error) {
+	logger.WithContext(context.Background()).Warnf("Tunnel %s ended: %s", key, sessionEndReason(err))
+}
+
+// DialWS Dial the tunnel to the server through nextAddr, goAway may be nil and is called once a hop asks
+// to open the next streams on a new tunnel. Every phase has a deadline, so that a next hop that stopped
+// answering fails the dial and the next one is tried.
+func (a *Client) DialWS(ctx context.Context, nextAddr *schema.NextServer, conf *schema.ClientConfig, goAway func()) (net.Conn, error) {
+	tlsConfig, err := DialTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	// The next hop must be the relay or server expected by the configuration, whatever its hostname
+	tlsConfig.VerifyPeerCertificate = VerifyPeer(nextAddr.UUID, "")
+	rawConn, err := dialer().DialContext(ctx, "tcp", nextAddr.Host+":"+nextAddr.Port)
 	if err != nil {
 		event.NewClientEvent(conf, event.TagConnectFail, err.Error()).Error(ctx)
 		return nil, errors.WithStack(err)
 	}
+	conn := tls.Client(rawConn, tlsConfig)
+	setPhaseDeadline(conn, tlsHandshakeTimeout())
+	if err = conn.Handshake(); err != nil {
+		_ = conn.Close()
+		event.NewClientEvent(conf, event.TagServerTLSFail, err.Error()).Error(ctx)
+		return nil, errors.WithStack(err)
+	}
+	tunnel, err := a.upgrade(ctx, conn, nextAddr, conf, goAway)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	setPhaseDeadline(conn, 0)
+	return tunnel, nil
+}
+
+// upgrade Upgrade the TLS connection to the next hop to the tunnel to the server
+func (a *Client) upgrade(ctx context.Context, conn net.Conn, nextAddr *schema.NextServer, conf *schema.ClientConfig, goAway func()) (net.Conn, error) {
 	secretLink := "secretLink"
 	req, err := http.NewRequest("GET", "/"+secretLink, nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	req.Host = nextAddr.Host
+	wsKey, err := websocket.SetRequestHeaders(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 	traceID, _ := contextx.FromTraceID(ctx)
-	req.Header.Set("Connection", "Upgrade")
-	req.Header.Set("Upgrade", "websocket")
 	req.Header.Set("X-TraceID", traceID)
 	req.Header.Set("X-Chains", conf.ToJSONString())
 	req.Header.Set("X-ClientCert", base64.StdEncoding.EncodeToString([]byte(config.C.Certificate.CertPem)))
 
+	setPhaseDeadline(conn, requestTimeout())
 	err = req.Write(conn)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	connReader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(connReader, req)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	if resp.Status == "101 Switching Protocols" &&
-		strings.ToLower(resp.Header.Get("Upgrade")) == "websocket" &&
-		strings.ToLower(resp.Header.Get("Connection")) == "upgrade" {
-		// Obtain the server certificate
-		serverCa := resp.Header.Get("X-ServerCert")
-		if resp.Header.Get("X-ServerCert") == "" {
-			err = errors.New("Failed to obtain the lower-layer service certificate. Procedure")
-			return nil, errors.WithStack(err)
+	wsErr := websocket.CheckResponse(resp, wsKey)
+	if wsErr == nil {
+		wsConn := websocket.NewConn(conn, connReader, true)
+		if goAway != nil {
+			wsConn.SetPingHandler(func(appData []byte) {
+				if isGoAway(appData) {
+					goAway()
+				}
+			})
 		}
-		serverCaCert, err := base64.StdEncoding.DecodeString(serverCa)
+		// The relays dial their next hops meanwhile
+		setPhaseDeadline(conn, tunnelReadyTimeout(len(conf.Relays)))
+		_, err = wsConn.Write([]byte("serverCaReady"))
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		// Verify the server certificate
-		err = certificate.NewVerify(string(serverCaCert), config.C.Certificate.CaPem, nextAddr.Host).Verify()
-		if err != nil {
-			//event.NewClientEvent(conf, event.TagServerTLSFail, err.Error()).Error(ctx)
-			//return nil, errors.WithStack(err)
+		// Prove possession of our private key to the server
+		if err = answerChallenge(wsConn); err != nil {
+			event.NewClientEvent(conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+			return nil, err
 		}
-		_, err = conn.Write([]byte("serverCaReady"))
+		// End-to-end TLS with the server, relays only see ciphertext
+		innerConn, err := innerClient(wsConn, conf)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			event.NewClientEvent(conf, event.TagServerTLSFail, err.Error()).Error(ctx)
+			return nil, err
 		}
-		return conn, nil
+		return innerConn, nil
 	}
 	respBytes, err := httputil.DumpResponse(resp, false)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	err = errors.New("Got unexpected response:\n" + string(respBytes) + "\nstatus:" + resp.Status)
+	err = errors.Wrap(wsErr, "Got unexpected response:\n"+string(respBytes)+"\nstatus:"+resp.Status)
 	return nil, errors.WithStack(err)
 }
 
+// Listen Serve the client port until ctx is done, the connections in flight are left to Drain
 func (a *Client) Listen(ctx context.Context, attrs map[string]interface{}) error {
 	conf, err := schema.ParseClientConfig(attrs)
 	if err != nil {
 		return err
 	}
-	ln, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(conf.Port))
+	items, err := listenerConfigs(conf.Port, true)
 	if err != nil {
 		return err
 	}
-	logger.WithContext(ctx).Printf("Started ZERO ACCESS Client at %v\n", ln.Addr().String())
+	var lns []net.Listener
+	for _, item := range items {
+		var ln net.Listener
+		switch {
+		case item.Network == "unix" && config.C.Client.IsTransparent():
+			err = errors.NewWithStack("Transparent mode cannot listen on a unix socket")
+		case item.Network == "unix":
+			ln, err = listenUnix(item.Address)
+		case config.C.Client.IsTransparent():
+			ln, err = listenTransparent(ctx, item.Network, item.Address)
+		default:
+			ln, err = listenTCP(ctx, item.Network, item.Address)
+		}
+		if err != nil {
+			return err
+		}
+		logger.WithContext(ctx).Printf("Started ZERO ACCESS Client at %v\n", ln.Addr().String())
+		closeOnDone(ctx, ln)
+		lns = append(lns, ln)
+	}
+	a.paths = NewPathSelector(conf)
+	go a.paths.Run(ctx)
+	if conf.ServerGroup != nil && len(conf.ServerGroup.Servers) > 0 {
+		a.balancer = NewServerBalancer(conf.ServerGroup, func(next *schema.NextServer, healthy bool, err error) {
+			msg := fmt.Sprintf("Server %s %s:%s", next.UUID, next.Host, next.Port)
+			if !healthy {
+				event.NewClientEvent(conf, event.TagHopDown, msg+" "+err.Error()).Warn(ctx)
+				return
+			}
+			event.NewClientEvent(conf, event.TagHopUp, msg).Info(ctx)
+		})
+		// Behind relays the members cannot be reached from here, the last relay checks them
+		if len(conf.Relays) == 0 {
+			go a.balancer.Run(ctx, func(next *schema.NextServer) error {
+				return probeTLS(next, healthTimeout())
+			})
+		}
+	}
+	handle := a.handleConn
+	if config.C.Client.IsSocks5() {
+		// Destinations are requested per connection and authorized against the resources
+		handle = a.handleSocks
+	} else if config.C.Client.IsTransparent() {
+		// Destinations are the original ones of the redirected connections
+		handle = a.handleTransparent
+	} else if conf.VerifyTarget(schema.NetworkUDP, conf.Target) {
+		// Datagrams are taken on the addresses of the TCP listeners
+		for _, item := range items {
+			if item.Network == "unix" {
+				continue
+			}
+			network := "udp" + strings.TrimPrefix(item.Network, "tcp")
+			address := item.Address
+			go func() {
+				if err := a.ListenUDP(ctx, conf, network, address); err != nil {
+					logger.WithErrorStack(ctx, err).Errorf("Failed to listen UDP: %v", err)
+				}
+			}()
+		}
+	}
+	if config.C.Client.DNSAddr != "" {
+		a.dns, err = newFakeDNS(config.C.Client.DNSPool)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := a.ListenDNS(ctx, conf, config.C.Client.DNSAddr); err != nil {
+				logger.WithErrorStack(ctx, err).Errorf("Failed to listen DNS: %v", err)
+			}
+		}()
+	}
+	if config.C.Client.HTTPProxyAddr != "" {
+		go func() {
+			if err := a.ListenHTTPProxy(ctx, conf, config.C.Client.HTTPProxyAddr); err != nil {
+				logger.WithErrorStack(ctx, err).Errorf("Failed to listen HTTP proxy: %v", err)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for _, ln := range lns {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			serveListener(ctx, ln, func(clientConn net.Conn) {
+				end := a.drainer.Begin()
+				recover.Recovery(ctx, func() {
+					defer end()
+					handle(ctx, conf, clientConn)
+				})
+			})
+		}(ln)
+	}
+	wg.Wait()
+	return nil
+}
+
+// Drain Wait for the connections in flight once Listen stopped accepting, the UDP flows are not waited for
+func (a *Client) Drain(ctx context.Context) {
+	a.drainer.Drain(ctx, drainTimeout())
+}
+
+// ListenUDP Forward the datagrams received on address, one stream per source address
+func (a *Client) ListenUDP(ctx context.Context, conf *schema.ClientConfig, network, address string) error {
+	pc, err := net.ListenPacket(network, address)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer pc.Close()
+	logger.WithContext(ctx).Printf("Started ZERO ACCESS Client UDP at %v\n", pc.LocalAddr().String())
+	closeOnDone(ctx, pc)
 
+	flows := newUDPFlows()
+	defer flows.close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		timeout := udpIdleTimeout()
+		ticker := time.NewTicker(expireInterval(timeout))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				flows.expire(timeout)
+			}
+		}
+	}()
+	buf := make([]byte, maxDatagram)
 	for {
-		clientConn, err := ln.Accept()
+		n, addr, err := pc.ReadFrom(buf)
 		if err != nil {
-			logger.WithErrorStack(ctx, errors.WithStack(err)).Error("Failed to accept connection:", err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.WithErrorStack(ctx, errors.WithStack(err)).Error("Failed to read datagram:", err)
 			continue
 		}
-		recover.Recovery(ctx, func() {
-			a.handleConn(ctx, conf, clientConn)
-		})
+		key := addr.String()
+		flow := flows.get(key)
+		if flow == nil {
+			// The stream is opened aside, the datagrams of the flow are held meanwhile
+			flow = newUDPFlow(nil)
+			flows.add(key, flow)
+			flowCtx := newTraceContext(ctx)
+			recover.Recovery(flowCtx, func() {
+				a.handleUDPFlow(flowCtx, conf, pc, addr, flows, flow)
+			})
+		}
+		stream := flow.pend(buf[:n])
+		if stream == nil {
+			continue
+		}
+		if err = writeDatagram(stream, buf[:n]); err != nil {
+			flow.end(CloseReasonServerError)
+			flow.close()
+			flows.remove(key, flow)
+			continue
+		}
+		flow.sent(n)
+	}
+}
+
+// handleUDPFlow Send the datagrams of the stream back to the source address until the flow ends
+func (a *Client) handleUDPFlow(ctx context.Context, conf *schema.ClientConfig, pc net.PacketConn, addr net.Addr, flows *udpFlows, flow *udpFlow) {
+	key := addr.String()
+	stream, err := a.openStream(ctx, conf, &schema.StreamHeader{Network: schema.NetworkUDP, Source: key})
+	if err != nil {
+		flow.close()
+		flows.remove(key, flow)
+		logger.WithErrorStack(ctx, err).Errorf("Failed to open UDP flow for %s: %v", key, err)
+		return
+	}
+	defer func() {
+		flow.close()
+		flows.remove(key, flow)
+		logger.WithContext(ctx).Infof("Closed UDP flow: %v\n", key)
+		a.recordSession(ctx, conf, targetAddr(conf.Target), flow.result())
+	}()
+	if !flow.open(stream) {
+		return
+	}
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := readDatagram(flow.stream, buf)
+		if err != nil {
+			flow.end(CloseReasonServerClosed)
+			return
+		}
+		if _, err = pc.WriteTo(buf[:n], addr); err != nil {
+			flow.end(CloseReasonClientError)
+			return
+		}
+		flow.received(n)
 	}
 }
 
 func (a *Client) handleConn(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn) {
-	begin := time.Now()
+	ctx = newTraceContext(ctx)
+	defer closeClientConn(ctx, clientConn)
+	stream, err := a.openStream(ctx, conf, &schema.StreamHeader{Network: schema.NetworkTCP, Source: clientConn.RemoteAddr().String()})
+	if err != nil {
+		logger.WithErrorStack(ctx, err).Errorf("The client failed to request the lower level service. Procedure:Error:%v", err)
+		return
+	}
+	defer stream.Close()
+	a.recordSession(ctx, conf, targetAddr(conf.Target), TransparentProxy(clientConn, stream))
+}
+
+// recordSession Report a finished connection of the client to target
+func (a *Client) recordSession(ctx context.Context, conf *schema.ClientConfig, target string, result *ProxyResult) {
+	recordSession(ctx, event.NewClientEvent(conf, event.TagDisconnect, ""), conf.UUID, target, "", result, conf.UUID, conf.Name)
+}
+
+// targetAddr The host:port of target
+func targetAddr(target schema.Target) string {
+	return net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+}
+
+// verifyTarget Verify that the client is granted a destination requested through a proxy listener.
+// A synthetic address of the DNS responder is replaced by the name it stands for.
+func (a *Client) verifyTarget(ctx context.Context, conf *schema.ClientConfig, network string, target schema.Target) (schema.Target, error) {
+	if a.dns != nil {
+		if name, ok := a.dns.lookup(net.ParseIP(target.Host)); ok {
+			target.Host = name
+		}
+	}
+	if conf.Resources.VerifyNetworkResources(network, target) {
+		return target, nil
+	}
+	err := fmt.Errorf("The requested %s resource %s is not granted to client %s", network,
+		net.JoinHostPort(target.Host, strconv.Itoa(target.Port)), conf.UUID)
+	event.NewClientEvent(conf, event.TagResourceNotFound, err.Error()).Error(ctx)
+	logger.WithContext(ctx).Warn(err)
+	return target, err
+}
+
+// newTraceContext Start the trace of a new connection
+func newTraceContext(ctx context.Context) context.Context {
 	traceID := trace.NewTraceID()
 	ctx = contextx.NewTraceID(ctx, traceID)
-	ctx = logger.NewTraceIDContext(ctx, traceID)
-	defer func() {
-		closeErr := clientConn.Close()
-		if closeErr != nil {
-			logger.WithErrorStack(ctx, errors.WithStack(closeErr)).Errorf("Closed Connection with error: %v\n", closeErr)
-		} else {
-			logger.WithContext(ctx).Infof("Closed Connection: %v\n", clientConn.RemoteAddr().String())
+	return logger.NewTraceIDContext(ctx, traceID)
+}
+
+// closeClientConn Close a local connection of the client
+func closeClientConn(ctx context.Context, clientConn net.Conn) {
+	closeErr := clientConn.Close()
+	if closeErr != nil {
+		logger.WithErrorStack(ctx, errors.WithStack(closeErr)).Errorf("Closed Connection with error: %v\n", closeErr)
+	} else {
+		logger.WithContext(ctx).Infof("Closed Connection: %v\n", clientConn.RemoteAddr().String())
+	}
+}
+
+// openStream Open a stream described by header, failing over to the next hop when one cannot be reached
+// and to the next member of the server group when the server cannot
+func (a *Client) openStream(ctx context.Context, conf *schema.ClientConfig, header *schema.StreamHeader) (net.Conn, error) {
+	begin := time.Now()
+	if header.Network == schema.NetworkTCP {
+		// TCP data is framed so that half-close crosses the tunnel
+		header.HalfClose = true
+	}
+	memberConf := conf
+	var next *schema.NextServer
+	if a.balancer != nil {
+		// One member of the server group per connection
+		next = a.balancer.Pick("")
+	}
+	var stream net.Conn
+	var err error
+	tried := make(map[string]bool)
+	for {
+		if next != nil {
+			if member := conf.ServerGroup.Member(next.UUID); member != nil {
+				memberConf = conf.WithServer(member.Server)
+			}
 		}
-	}()
-	nextServer := a.GetNextServer(conf)
-	serverConn, err := a.DialWS(ctx, nextServer, conf)
+		stream, err = a.openStreamVia(ctx, memberConf, header)
+		// Behind relays the last relay fails over between the members
+		if err == nil || a.balancer == nil || len(conf.Relays) > 0 {
+			break
+		}
+		if next = a.balancer.Failover(memberConf.Server.UUID, err, tried); next == nil {
+			break
+		}
+	}
 	end := time.Now().Sub(begin).String()
 	if err != nil {
 		metrics.AddDelayPoint(ctx, pconst.OperatorClient, metrics.ReqFail, end, conf.UUID, conf.Name)
-		logger.WithErrorStack(ctx, err).Errorf("The client failed to request the lower level service. Procedure:Addr:%s:%s Error:%v", nextServer.Host, nextServer.Port, err)
-		return
+		return nil, err
 	}
-	defer serverConn.Close()
 	event.NewClientEvent(conf, event.TagConnectSuccess, "").Info(ctx)
 	metrics.AddDelayPoint(ctx, pconst.OperatorClient, metrics.ReqSuccess, end, conf.UUID, conf.Name)
-	// 多路复用
-	//Setup client side of smux
-	session, err := smux.Client(serverConn, nil)
-	if err != nil {
-		logger.WithErrorStack(ctx, err).Errorf("smux.Client. Procedure:Addr:%s:%s Error:%v", nextServer.Host, nextServer.Port, err)
-		return
+	if a.balancer != nil {
+		stream = &releaseConn{Conn: stream, release: a.balancer.Acquire(memberConf.Server.UUID)}
+	}
+	return stream, nil
+}
+
+// openStreamVia Open a stream to the server of conf through the ranked hops
+func (a *Client) openStreamVia(ctx context.Context, conf *schema.ClientConfig, header *schema.StreamHeader) (net.Conn, error) {
+	var err error
+	for _, nextServer := range a.NextServers(conf) {
+		var stream net.Conn
+		stream, err = a.openStreamTo(ctx, conf, nextServer, header)
+		if err == nil {
+			return stream, nil
+		}
+		logFailover(ctx, nextServer, err)
 	}
-	defer session.Close()
-	// Open a new stream
-	stream, err := session.OpenStream()
+	return nil, err
+}
+
+// openStreamTo Open a stream through nextServer
+func (a *Client) openStreamTo(ctx context.Context, conf *schema.ClientConfig, nextServer *schema.NextServer, header *schema.StreamHeader) (net.Conn, error) {
+	// Reuse the multiplexed session to the next hop, dialing only when there is no live one
+	stream, err := a.sessions.OpenStream(ctx, a.sessionKey(nextServer, conf), func(goAway func()) (net.Conn, error) {
+		conn, err := a.DialWS(ctx, nextServer, conf, goAway)
+		if a.paths != nil {
+			a.paths.Report(ctx, nextServer, err)
+		}
+		return conn, err
+	})
 	if err != nil {
-		logger.WithErrorStack(ctx, err).Errorf("session.OpenStream. Procedure:Addr:%s:%s Error:%v", nextServer.Host, nextServer.Port, err)
-		return
+		return nil, errors.Wrapf(err, "Addr:%s:%s", nextServer.Host, nextServer.Port)
 	}
-	defer stream.Close()
-	TransparentProxy(clientConn, stream)
+	if err = writeStreamHeader(stream, header); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	if header.HalfClose {
+		return &framedStream{Conn: stream}, nil
+	}
+	return stream, nil
+}
+
+// sessionKey Sessions are shared per next hop and chain
+func (a *Client) sessionKey(nextServer *schema.NextServer, conf *schema.ClientConfig) string {
+	keys := []string{nextServer.Host + ":" + nextServer.Port, conf.UUID, conf.Server.UUID}
+	for _, item := range conf.Relays {
+		keys = append(keys, item.UUID)
+	}
+	return strings.Join(keys, "/")
 }
 
+// GetNextServer The best ranked relay or server to enter the chain through
 func (a *Client) GetNextServer(chains *schema.ClientConfig) *schema.NextServer {
-	replyCount := len(chains.Relays)
-	nextServer := new(schema.NextServer)
-	if replyCount == 0 {
-		nextServer.Host = chains.Server.Host
-		nextServer.Port = strconv.Itoa(chains.Server.OutPort)
-	} else {
-		chain := chains.Relays[0]
-		nextServer.Host = chain.Host
-		nextServer.Port = strconv.Itoa(chain.OutPort)
+	return a.NextServers(chains)[0]
+}
+
+// NextServers The relays and server to try in order, the chain order until Listen starts ranking them
+func (a *Client) NextServers(chains *schema.ClientConfig) []*schema.NextServer {
+	if a.paths != nil {
+		return a.paths.NextServers(&chains.Server)
 	}
-	return nextServer
+	return NewPathSelector(chains).NextServers(nil)
 }
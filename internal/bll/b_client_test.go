@@ -0,0 +1,84 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// silentHop Accept connections on loopback and never answer them, after the TLS handshake when tlsConfig is set
+func silentHop(t *testing.T, tlsConfig *tls.Config) *schema.NextServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			if tlsConfig != nil {
+				go func() {
+					tlsConn := tls.Server(conn, tlsConfig)
+					if tlsConn.Handshake() == nil {
+						_, _ = io.Copy(ioutil.Discard, tlsConn)
+					}
+				}()
+			}
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return &schema.NextServer{UUID: "test", Host: "127.0.0.1", Port: port}
+}
+
+func TestDialWSDeadlines(t *testing.T) {
+	defer setTestCertificate(t)()
+	defer func(handshake config.Handshake) { config.C.Handshake = handshake }(config.C.Handshake)
+	config.C.Handshake = config.Handshake{TLSTimeout: 1, RequestTimeout: 1}
+	tlsConfig, err := ListenTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		next *schema.NextServer
+	}{
+		{"no TLS handshake", silentHop(t, nil)},
+		{"no websocket response", silentHop(t, tlsConfig)},
+	}
+	relay := NewRelay()
+	for _, tt := range tests {
+		begin := time.Now()
+		if _, err := NewClient().DialWS(context.Background(), tt.next, &schema.ClientConfig{UUID: "client"}, nil); err == nil {
+			t.Errorf("%s: the client dialed", tt.name)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/secretLink", nil)
+		if _, err := relay.DialWS(context.Background(), tt.next, req, &schema.RelayConfig{}, &schema.ClientConfig{}); err == nil {
+			t.Errorf("%s: the relay dialed", tt.name)
+		}
+		if elapsed := time.Since(begin); elapsed > 4*time.Second {
+			t.Errorf("%s: failing took %s", tt.name, elapsed)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DNS message, RFC 1035
+const (
+	dnsHeaderLen  = 12
+	dnsMaxMessage = 4096
+	dnsMaxName    = 255
+
+	dnsFlagQR     = 0x8000
+	dnsFlagAA     = 0x0400
+	dnsFlagRD     = 0x0100
+	dnsOpcodeMask = 0x7800
+
+	dnsTypeA   = 1
+	dnsClassIN = 1
+
+	dnsRcodeFormErr = 1
+	dnsRcodeNotImp  = 4
+	dnsRcodeRefused = 5
+)
+
+// defaultDNSPool CGNAT range, not routed on the internet
+const defaultDNSPool = "100.64.0.0/10"
+
+// fakeDNS Synthetic IPv4 addresses handed out for dns resources and the names they stand for
+type fakeDNS struct {
+	mu     sync.Mutex
+	base   uint32
+	size   uint32
+	next   uint32
+	byName map[string]uint32
+	byAddr map[uint32]string
+}
+
+func newFakeDNS(cidr string) (*fakeDNS, error) {
+	if cidr == "" {
+		cidr = defaultDNSPool
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ip := subnet.IP.To4()
+	ones, bits := subnet.Mask.Size()
+	if ip == nil || bits-ones < 2 || bits-ones > 24 {
+		return nil, errors.NewWithStack("The DNS pool must be an IPv4 network between /8 and /30: " + cidr)
+	}
+	return &fakeDNS{
+		base:   binary.BigEndian.Uint32(ip),
+		size:   1 << uint(bits-ones),
+		next:   1,
+		byName: make(map[string]uint32),
+		byAddr: make(map[uint32]string),
+	}, nil
+}
+
+// allocate Return the address of name, the oldest address is reused once the pool is exhausted
+func (a *fakeDNS) allocate(name string) net.IP {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	offset, ok := a.byName[name]
+	if !ok {
+		offset = a.next
+		// The network and broadcast addresses are never handed out
+		a.next++
+		if a.next >= a.size-1 {
+			a.next = 1
+		}
+		if old, ok := a.byAddr[offset]; ok {
+			delete(a.byName, old)
+		}
+		a.byName[name] = offset
+		a.byAddr[offset] = name
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, a.base+offset)
+	return ip
+}
+
+// lookup Return the name a synthetic address stands for
+func (a *fakeDNS) lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	offset := binary.BigEndian.Uint32(ip4) - a.base
+	if offset >= a.size {
+		return "", false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	name, ok := a.byAddr[offset]
+	return name, ok
+}
+
+// ListenDNS Answer the A queries for dns resources with synthetic addresses, the other names are refused
+func (a *Client) ListenDNS(ctx context.Context, conf *schema.ClientConfig, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer pc.Close()
+	logger.WithContext(ctx).Printf("Started ZERO ACCESS Client DNS at %v\n", pc.LocalAddr().String())
+	closeOnDone(ctx, pc)
+	buf := make([]byte, dnsMaxMessage)
+	for {
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.WithErrorStack(ctx, errors.WithStack(err)).Error("Failed to read DNS query:", err)
+			continue
+		}
+		resp := a.answerDNS(ctx, conf, buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err = pc.WriteTo(resp, raddr); err != nil {
+			logger.WithErrorStack(ctx, errors.WithStack(err)).Error("Failed to write DNS response:", err)
+		}
+	}
+}
+
+// answerDNS Build the response to a query, nil when it does not deserve one
+func (a *Client) answerDNS(ctx context.Context, conf *schema.ClientConfig, query []byte) []byte {
+	if len(query) < dnsHeaderLen {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&dnsFlagQR != 0 {
+		return nil
+	}
+	if flags&dnsOpcodeMask != 0 {
+		return dnsResponse(query, dnsRcodeNotImp, nil, nil)
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return dnsResponse(query, dnsRcodeFormErr, nil, nil)
+	}
+	name, end, err := parseDNSName(query, dnsHeaderLen)
+	if err != nil || end+4 > len(query) {
+		return dnsResponse(query, dnsRcodeFormErr, nil, nil)
+	}
+	question := query[dnsHeaderLen : end+4]
+	if !conf.Resources.MatchDomain(name) {
+		return dnsResponse(query, dnsRcodeRefused, question, nil)
+	}
+	qtype := binary.BigEndian.Uint16(query[end:])
+	qclass := binary.BigEndian.Uint16(query[end+2:])
+	if qtype != dnsTypeA || qclass != dnsClassIN {
+		// The name exists, but only with an A record
+		return dnsResponse(query, 0, question, nil)
+	}
+	ip := a.dns.allocate(name)
+	logger.WithContext(ctx).Debugf("DNS %s -> %s", name, ip)
+	return dnsResponse(query, 0, question, ip)
+}
+
+// parseDNSName Parse the uncompressed name at offset, returns it in lower case and the offset following it
+func parseDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	size := 0
+	for {
+		if offset >= len(msg) {
+			return "", 0, errors.NewWithStack("Short DNS name")
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length&0xc0 != 0 {
+			return "", 0, errors.NewWithStack("Compressed DNS name in question")
+		}
+		size += length + 1
+		if size > dnsMaxName || offset+length > len(msg) {
+			return "", 0, errors.NewWithStack("Invalid DNS name")
+		}
+		labels = append(labels, strings.ToLower(string(msg[offset:offset+length])))
+		offset += length
+	}
+	return strings.Join(labels, "."), offset, nil
+}
+
+// dnsResponse Build a response to query with its question and an optional A answer
+func dnsResponse(query []byte, rcode uint16, question []byte, ip net.IP) []byte {
+	ttl := config.C.Client.DNSTTL
+	if ttl <= 0 {
+		ttl = 60
+	}
+	resp := make([]byte, dnsHeaderLen, dnsHeaderLen+len(question)+16)
+	copy(resp, query[:2])
+	flags := binary.BigEndian.Uint16(query[2:])
+	binary.BigEndian.PutUint16(resp[2:], dnsFlagQR|dnsFlagAA|flags&dnsFlagRD|rcode)
+	if question != nil {
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		resp = append(resp, question...)
+	}
+	if ip != nil {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		// Pointer to the name of the question
+		resp = append(resp, 0xc0, dnsHeaderLen)
+		resp = append(resp, 0, dnsTypeA, 0, dnsClassIN)
+		resp = append(resp, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+		resp = append(resp, 0, net.IPv4len)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp
+}
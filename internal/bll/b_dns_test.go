@@ -0,0 +1,169 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"net"
+	"strings"
+	"testing"
+)
+
+// dnsQuery A query of one question for name
+func dnsQuery(id, flags uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	return append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+func testDNSClient(t *testing.T) (*Client, *schema.ClientConfig) {
+	dns, err := newFakeDNS("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &schema.ClientConfig{Resources: schema.Resources{{Type: "dns", Host: "*.corp.com", Port: "443"}}}
+	return &Client{dns: dns}, conf
+}
+
+func TestAnswerDNS(t *testing.T) {
+	client, conf := testDNSClient(t)
+	query := dnsQuery(0x1234, dnsFlagRD, "DB.Corp.com", dnsTypeA)
+	resp := client.answerDNS(context.Background(), conf, query)
+	if len(resp) != len(query)+16 {
+		t.Fatalf("response of %d bytes", len(resp))
+	}
+	if binary.BigEndian.Uint16(resp) != 0x1234 {
+		t.Error("the id was not echoed")
+	}
+	if flags := binary.BigEndian.Uint16(resp[2:]); flags != dnsFlagQR|dnsFlagAA|dnsFlagRD {
+		t.Errorf("flags %#x", flags)
+	}
+	if qd, an := binary.BigEndian.Uint16(resp[4:]), binary.BigEndian.Uint16(resp[6:]); qd != 1 || an != 1 {
+		t.Errorf("%d questions and %d answers", qd, an)
+	}
+	answer := resp[len(query):]
+	if answer[0] != 0xc0 || answer[1] != dnsHeaderLen || binary.BigEndian.Uint16(answer[2:]) != dnsTypeA {
+		t.Errorf("answer %x", answer)
+	}
+	ip := net.IP(answer[12:16])
+	_, pool, _ := net.ParseCIDR(defaultDNSPool)
+	if !pool.Contains(ip) {
+		t.Errorf("answered %s outside of the pool", ip)
+	}
+	if name, ok := client.dns.lookup(ip); !ok || name != "db.corp.com" {
+		t.Errorf("%s stands for %q", ip, name)
+	}
+	again := client.answerDNS(context.Background(), conf, dnsQuery(1, 0, "db.corp.com", dnsTypeA))
+	if !net.IP(again[len(again)-4:]).Equal(ip) {
+		t.Error("the same name got another address")
+	}
+}
+
+func TestAnswerDNSRejected(t *testing.T) {
+	client, conf := testDNSClient(t)
+	compressed := dnsQuery(1, 0, "db.corp.com", dnsTypeA)[:dnsHeaderLen]
+	compressed = append(compressed, 0xc0, 0x0c, 0, dnsTypeA, 0, dnsClassIN)
+	twoQuestions := dnsQuery(1, 0, "db.corp.com", dnsTypeA)
+	binary.BigEndian.PutUint16(twoQuestions[4:], 2)
+	tests := []struct {
+		name      string
+		query     []byte
+		rcode     uint16
+		questions uint16
+	}{
+		{"other name", dnsQuery(1, 0, "example.com", dnsTypeA), dnsRcodeRefused, 1},
+		{"suffix of another domain", dnsQuery(1, 0, "db.corp.com.example.com", dnsTypeA), dnsRcodeRefused, 1},
+		{"AAAA", dnsQuery(1, 0, "db.corp.com", 28), 0, 1},
+		{"opcode", dnsQuery(1, 0x0800, "db.corp.com", dnsTypeA), dnsRcodeNotImp, 0},
+		{"two questions", twoQuestions, dnsRcodeFormErr, 0},
+		{"compressed name", compressed, dnsRcodeFormErr, 0},
+		{"truncated question", dnsQuery(1, 0, "db.corp.com", dnsTypeA)[:dnsHeaderLen+13], dnsRcodeFormErr, 0},
+		{"label past the end", append(dnsQuery(1, 0, "db", dnsTypeA)[:dnsHeaderLen], 10, 'a'), dnsRcodeFormErr, 0},
+	}
+	for _, tt := range tests {
+		resp := client.answerDNS(context.Background(), conf, tt.query)
+		if len(resp) < dnsHeaderLen {
+			t.Errorf("%s: response %x", tt.name, resp)
+			continue
+		}
+		flags := binary.BigEndian.Uint16(resp[2:])
+		if flags&dnsFlagQR == 0 || flags&0x0f != tt.rcode {
+			t.Errorf("%s: flags %#x, want rcode %d", tt.name, flags, tt.rcode)
+		}
+		if qd, an := binary.BigEndian.Uint16(resp[4:]), binary.BigEndian.Uint16(resp[6:]); qd != tt.questions || an != 0 {
+			t.Errorf("%s: %d questions and %d answers", tt.name, qd, an)
+		}
+	}
+
+	// Responses and runts are not answered
+	response := dnsQuery(1, dnsFlagQR, "db.corp.com", dnsTypeA)
+	for _, query := range [][]byte{response, response[:dnsHeaderLen-1]} {
+		if resp := client.answerDNS(context.Background(), conf, query); resp != nil {
+			t.Errorf("answered %x", query)
+		}
+	}
+}
+
+func TestParseDNSName(t *testing.T) {
+	msg := dnsQuery(1, 0, "Intranet.CORP.com", dnsTypeA)
+	name, end, err := parseDNSName(msg, dnsHeaderLen)
+	if err != nil || name != "intranet.corp.com" || end != len(msg)-4 {
+		t.Errorf("parsed %q ending at %d, %v", name, end, err)
+	}
+	long := dnsQuery(1, 0, strings.Repeat(strings.Repeat("a", 63)+".", 4)+"com", dnsTypeA)
+	if _, _, err = parseDNSName(long, dnsHeaderLen); err == nil {
+		t.Error("a name over 255 bytes was parsed")
+	}
+	if _, _, err = parseDNSName(msg[:dnsHeaderLen+5], dnsHeaderLen); err == nil {
+		t.Error("a truncated name was parsed")
+	}
+}
+
+func TestFakeDNSPool(t *testing.T) {
+	dns, err := newFakeDNS("10.0.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := dns.allocate("a.corp.com"), dns.allocate("b.corp.com")
+	if !first.Equal(net.IPv4(10, 0, 0, 1)) || !second.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("allocated %s and %s", first, second)
+	}
+	// Exhausted, the oldest address is reused
+	if third := dns.allocate("c.corp.com"); !third.Equal(first) {
+		t.Errorf("allocated %s once exhausted, want %s", third, first)
+	}
+	if _, ok := dns.lookup(first); !ok {
+		t.Error("the reused address stands for nothing")
+	}
+	if name, _ := dns.lookup(first); name != "c.corp.com" {
+		t.Errorf("the reused address stands for %q", name)
+	}
+	for _, ip := range []net.IP{net.IPv4(10, 0, 0, 4), net.IPv4(9, 255, 255, 255), net.ParseIP("::1")} {
+		if name, ok := dns.lookup(ip); ok {
+			t.Errorf("%s stands for %q", ip, name)
+		}
+	}
+	for _, cidr := range []string{"10.0.0.0/31", "10.0.0.0/7", "fd00::/64", "bogus"} {
+		if _, err := newFakeDNS(cidr); err == nil {
+			t.Errorf("pool %s was accepted", cidr)
+		}
+	}
+}
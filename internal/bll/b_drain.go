@@ -0,0 +1,154 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bytes"
+	"context"
+	"github.com/xtaci/smux"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"github.com/ztalab/ZASentinel/pkg/websocket"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval How often a drain checks whether the connections ended
+const drainPollInterval = 100 * time.Millisecond
+
+// drainLogInterval How often a drain logs its progress
+const drainLogInterval = 5 * time.Second
+
+// goAwayPing Application data of the websocket ping asking the previous hop to open its next streams on
+// a new tunnel, those in flight end on this one
+var goAwayPing = []byte("goaway")
+
+// Drainer Counts the proxied connections in flight of a client, relay or server so that a shutdown can wait for them
+type Drainer struct {
+	active int64
+}
+
+func NewDrainer() *Drainer {
+	return new(Drainer)
+}
+
+// Begin Account a proxied connection, end is called once it ended
+func (a *Drainer) Begin() (end func()) {
+	atomic.AddInt64(&a.active, 1)
+	var ended int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&ended, 0, 1) {
+			atomic.AddInt64(&a.active, -1)
+		}
+	}
+}
+
+// Active The proxied connections in flight
+func (a *Drainer) Active() int64 {
+	return atomic.LoadInt64(&a.active)
+}
+
+// Drain Wait up to timeout for the proxied connections in flight to end, logging the progress.
+// Reports whether they all ended.
+func (a *Drainer) Drain(ctx context.Context, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	poll := time.NewTicker(drainPollInterval)
+	defer poll.Stop()
+	progress := time.NewTicker(drainLogInterval)
+	defer progress.Stop()
+	if active := a.Active(); active > 0 {
+		logger.WithContext(ctx).Infof("Draining %d connections, waiting up to %s", active, timeout)
+	}
+	for {
+		active := a.Active()
+		if active <= 0 {
+			logger.WithContext(ctx).Infof("All connections drained")
+			return true
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			logger.WithContext(ctx).Warnf("Drain deadline reached, cutting %d connections", active)
+			return false
+		}
+		select {
+		case <-poll.C:
+		case <-progress.C:
+			logger.WithContext(ctx).Infof("Draining %d connections, %s left", active, left.Round(time.Second))
+		}
+	}
+}
+
+// drainTimeout Seconds the proxied connections may take to end on shutdown
+func drainTimeout() time.Duration {
+	if config.C.Shutdown.DrainTimeout > 0 {
+		return time.Duration(config.C.Shutdown.DrainTimeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// closeOnDone Close the listener once ctx is done so that its accept loop ends
+func closeOnDone(ctx context.Context, l interface{ Close() error }) {
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+}
+
+// closeWhenIdle Close the tunnel session once ctx is done and none of its streams is open, the previous
+// hop then dials another relay or server for its next connections. stop is called once the session is served.
+func closeWhenIdle(ctx context.Context, session *smux.Session) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		poll := time.NewTicker(drainPollInterval)
+		defer poll.Stop()
+		for {
+			if session.NumStreams() == 0 {
+				_ = session.Close()
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-poll.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// isGoAway Whether a websocket ping asks to move to a new tunnel
+func isGoAway(appData []byte) bool {
+	return bytes.Equal(appData, goAwayPing)
+}
+
+// goAwayOnDone Ask the previous hop of the tunnel over conn to move to a new tunnel once ctx is done, it
+// closes this one once its streams ended. stop is called once the tunnel is served.
+func goAwayOnDone(ctx context.Context, conn *websocket.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			_ = conn.Ping(goAwayPing)
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
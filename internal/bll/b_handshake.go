@@ -0,0 +1,233 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/metrics"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/util/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// wsPreamble Start of the websocket request of every previous hop
+const wsPreamble = "GET /secretLink"
+
+func handshakeTimeout(seconds int) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// tlsHandshakeTimeout Time the previous hop has to complete the TLS handshake
+func tlsHandshakeTimeout() time.Duration {
+	return handshakeTimeout(config.C.Handshake.TLSTimeout)
+}
+
+// requestTimeout Time the previous hop has to send the websocket request after the TLS handshake
+func requestTimeout() time.Duration {
+	return handshakeTimeout(config.C.Handshake.RequestTimeout)
+}
+
+// writeTimeout Time the previous hop has to take the response
+func writeTimeout() time.Duration {
+	return handshakeTimeout(config.C.Handshake.WriteTimeout)
+}
+
+// readyTimeout Time the previous hop has to send the certificate verification result, servers also wait
+// as long for the end-to-end TLS handshake
+func readyTimeout() time.Duration {
+	return handshakeTimeout(config.C.Handshake.ReadyTimeout)
+}
+
+// dialTimeout Time to connect to the next hop or a resource
+func dialTimeout() time.Duration {
+	return handshakeTimeout(config.C.Handshake.DialTimeout)
+}
+
+// tunnelReadyTimeout Time the next hop has to answer the certificate verification result, relays is the
+// number of relays it may still dial toward the server, each taking up to the phases of a dial
+func tunnelReadyTimeout(relays int) time.Duration {
+	return readyTimeout() + time.Duration(relays)*(dialTimeout()+tlsHandshakeTimeout()+requestTimeout()+writeTimeout())
+}
+
+func maxHeaderBytes() int64 {
+	if config.C.Handshake.MaxHeaderBytes > 0 {
+		return int64(config.C.Handshake.MaxHeaderBytes)
+	}
+	return 64 << 10
+}
+
+func maxChainsBytes() int {
+	if config.C.Handshake.MaxChainsBytes > 0 {
+		return config.C.Handshake.MaxChainsBytes
+	}
+	return 32 << 10
+}
+
+// HandshakeError A handshake of a previous hop rejected for Reason, one of the metrics Reject reasons.
+// Status is the HTTP status the previous hop is answered with, it is disconnected without an answer when 0.
+type HandshakeError struct {
+	Reason string
+	Status int
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	return e.Err.Error()
+}
+
+func handshakeError(reason string, status int, err error) error {
+	return errors.WithStack(&HandshakeError{Reason: reason, Status: status, Err: err})
+}
+
+// rejectReason The reason err rejects the handshake for, timeouts of the phase count as timeoutReason.
+// Empty when the previous hop just went away.
+func rejectReason(err error, timeoutReason string) string {
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return handshakeErr.Reason
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return timeoutReason
+	}
+	return ""
+}
+
+// rejectHandshake Count the handshake of conn rejected by err and answer the previous hop when the
+// rejection has a status
+func rejectHandshake(ctx context.Context, operator string, conn net.Conn, err error, timeoutReason, id, name string) {
+	reason := rejectReason(err, timeoutReason)
+	if reason == "" {
+		return
+	}
+	metrics.AddRejectPoint(ctx, operator, reason, conn.RemoteAddr().String(), id, name)
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) && handshakeErr.Status != 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout()))
+		rejectConn(conn, &AdmissionError{Status: handshakeErr.Status, Reason: handshakeErr.Error()})
+	}
+}
+
+// headerLimit Reader of the connection of a previous hop, capping the bytes read until lifted once the
+// request line and headers were read
+type headerLimit struct {
+	r         io.Reader
+	remaining int64
+	lifted    bool
+	exceeded  bool
+}
+
+func newHeaderLimit(r io.Reader) *headerLimit {
+	return &headerLimit{r: r, remaining: maxHeaderBytes()}
+}
+
+func (l *headerLimit) Read(p []byte) (int, error) {
+	if l.lifted {
+		return l.r.Read(p)
+	}
+	if l.remaining <= 0 {
+		l.exceeded = true
+		return 0, errors.NewWithStack("the request headers exceed the limit")
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+func (l *headerLimit) lift() {
+	l.lifted = true
+}
+
+// checkPreamble Reject the connection as soon as what the previous hop sent differs from the websocket
+// request, without waiting for more
+func checkPreamble(connReader *bufio.Reader) error {
+	n := 1
+	for {
+		buf, err := connReader.Peek(n)
+		if !strings.HasPrefix(wsPreamble, string(buf)) {
+			return handshakeError(metrics.RejectPreamble, 0, fmt.Errorf("the connection starts with %q instead of a websocket request", buf))
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if n == len(wsPreamble) {
+			return nil
+		}
+		// Whatever arrived already is checked at once
+		n++
+		if buffered := connReader.Buffered(); buffered > n {
+			n = buffered
+		}
+		if n > len(wsPreamble) {
+			n = len(wsPreamble)
+		}
+	}
+}
+
+// readRequest Read the request of the previous hop within the header limit, which is lifted once read
+func readRequest(connReader *bufio.Reader, limit *headerLimit) (*http.Request, error) {
+	req, err := http.ReadRequest(connReader)
+	if err != nil {
+		if limit.exceeded {
+			return nil, handshakeError(metrics.RejectHeaderSize, http.StatusRequestHeaderFieldsTooLarge,
+				fmt.Errorf("the request headers exceed %d bytes", maxHeaderBytes()))
+		}
+		var netErr net.Error
+		if err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &netErr) {
+			return nil, errors.WithStack(err)
+		}
+		return nil, handshakeError(metrics.RejectMalformed, http.StatusBadRequest, err)
+	}
+	limit.lift()
+	return req, nil
+}
+
+// readChains Parse the X-Chains header of the request within the size limit
+func readChains(req *http.Request) (*schema.ClientConfig, error) {
+	chainsJSON := req.Header.Get("X-Chains")
+	if chainsJSON == "" {
+		return nil, handshakeError(metrics.RejectMalformed, http.StatusBadRequest, fmt.Errorf("X-Chains argument is missing"))
+	}
+	if len(chainsJSON) > maxChainsBytes() {
+		return nil, handshakeError(metrics.RejectChainsSize, http.StatusRequestHeaderFieldsTooLarge,
+			fmt.Errorf("X-Chains of %d bytes exceeds %d bytes", len(chainsJSON), maxChainsBytes()))
+	}
+	var chains schema.ClientConfig
+	if err := json.Unmarshal([]byte(chainsJSON), &chains); err != nil {
+		return nil, handshakeError(metrics.RejectMalformed, http.StatusBadRequest, err)
+	}
+	return &chains, nil
+}
+
+// setPhaseDeadline Give the previous hop timeout to complete the next phase of the handshake, a zero
+// timeout clears the deadlines before proxying
+func setPhaseDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout == 0 {
+		_ = conn.SetDeadline(time.Time{})
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+}
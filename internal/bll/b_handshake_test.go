@@ -0,0 +1,190 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/metrics"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimits(t *testing.T) {
+	defer func(handshake config.Handshake) { config.C.Handshake = handshake }(config.C.Handshake)
+	config.C.Handshake = config.Handshake{}
+	if tlsHandshakeTimeout() != 10*time.Second || requestTimeout() != 10*time.Second ||
+		writeTimeout() != 10*time.Second || readyTimeout() != 10*time.Second {
+		t.Error("the timeouts do not default to 10s")
+	}
+	if maxHeaderBytes() != 64<<10 || maxChainsBytes() != 32<<10 {
+		t.Errorf("size limits default to %d and %d", maxHeaderBytes(), maxChainsBytes())
+	}
+	config.C.Handshake = config.Handshake{TLSTimeout: 1, RequestTimeout: 2, WriteTimeout: 3, ReadyTimeout: 4, MaxHeaderBytes: 5, MaxChainsBytes: 6}
+	if tlsHandshakeTimeout() != time.Second || requestTimeout() != 2*time.Second ||
+		writeTimeout() != 3*time.Second || readyTimeout() != 4*time.Second {
+		t.Error("the configured timeouts are ignored")
+	}
+	if maxHeaderBytes() != 5 || maxChainsBytes() != 6 {
+		t.Errorf("size limits are %d and %d", maxHeaderBytes(), maxChainsBytes())
+	}
+}
+
+func TestHeaderLimit(t *testing.T) {
+	defer func(handshake config.Handshake) { config.C.Handshake = handshake }(config.C.Handshake)
+	config.C.Handshake = config.Handshake{MaxHeaderBytes: 10}
+	limit := newHeaderLimit(strings.NewReader("0123456789abcdef"))
+	got, err := io.ReadAll(limit)
+	if string(got) != "0123456789" || err == nil || !limit.exceeded {
+		t.Fatalf("read %q, %v, exceeded %v", got, err, limit.exceeded)
+	}
+	limit.lift()
+	if rest, err := io.ReadAll(limit); string(rest) != "abcdef" || err != nil {
+		t.Errorf("read %q, %v once lifted", rest, err)
+	}
+}
+
+func TestCheckPreamble(t *testing.T) {
+	tests := []struct {
+		input  string
+		reason string
+		ok     bool
+	}{
+		{"GET /secretLink HTTP/1.1\r\n", "", true},
+		{"GET /other HTTP/1.1\r\n", metrics.RejectPreamble, false},
+		{"\x16\x03\x01\x02\x00", metrics.RejectPreamble, false},
+		{"get /secretLink", metrics.RejectPreamble, false},
+		// The peer went away, nothing to count
+		{"GET /sec", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		err := checkPreamble(bufio.NewReader(strings.NewReader(tt.input)))
+		if (err == nil) != tt.ok || rejectReason(err, "timeout") != tt.reason {
+			t.Errorf("%q: err %v, reason %q", tt.input, err, rejectReason(err, "timeout"))
+		}
+	}
+
+	// The first byte that differs is rejected without waiting for more
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go func() {
+		_, _ = remote.Write([]byte("GX"))
+	}()
+	_ = local.SetReadDeadline(time.Now().Add(time.Second))
+	if err := checkPreamble(bufio.NewReader(local)); rejectReason(err, "timeout") != metrics.RejectPreamble {
+		t.Errorf("a partial preamble read %v", err)
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	defer func(handshake config.Handshake) { config.C.Handshake = handshake }(config.C.Handshake)
+	config.C.Handshake = config.Handshake{MaxHeaderBytes: 256}
+	read := func(input string) (*http.Request, *headerLimit, error) {
+		limit := newHeaderLimit(strings.NewReader(input))
+		req, err := readRequest(bufio.NewReader(limit), limit)
+		return req, limit, err
+	}
+	req, limit, err := read("GET /secretLink HTTP/1.1\r\nHost: relay\r\n\r\n" + strings.Repeat("x", 1000))
+	if err != nil || req.URL.Path != "/secretLink" || !limit.lifted {
+		t.Fatalf("read %v, %v, lifted %v", req, err, limit.lifted)
+	}
+
+	tests := []struct {
+		name   string
+		input  string
+		reason string
+		status int
+	}{
+		{"headers too large", "GET /secretLink HTTP/1.1\r\nX-Pad: " + strings.Repeat("x", 300) + "\r\n\r\n", metrics.RejectHeaderSize, http.StatusRequestHeaderFieldsTooLarge},
+		{"malformed", "GET /secretLink\r\n\r\n", metrics.RejectMalformed, http.StatusBadRequest},
+		{"truncated", "GET /secretLink HTTP/1.1\r\nHost:", "", 0},
+	}
+	for _, tt := range tests {
+		_, _, err := read(tt.input)
+		if err == nil {
+			t.Errorf("%s: read", tt.name)
+			continue
+		}
+		if reason := rejectReason(err, "timeout"); reason != tt.reason {
+			t.Errorf("%s: reason %q, want %q", tt.name, reason, tt.reason)
+		}
+		var handshakeErr *HandshakeError
+		if errors.As(err, &handshakeErr) && handshakeErr.Status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, handshakeErr.Status, tt.status)
+		}
+	}
+}
+
+func TestReadChains(t *testing.T) {
+	defer func(handshake config.Handshake) { config.C.Handshake = handshake }(config.C.Handshake)
+	config.C.Handshake = config.Handshake{MaxChainsBytes: 1024}
+	request := func(chains string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "/secretLink", nil)
+		if chains != "" {
+			req.Header.Set("X-Chains", chains)
+		}
+		return req
+	}
+	chains, err := readChains(request((&schema.ClientConfig{UUID: "client", Port: 80}).ToJSONString()))
+	if err != nil || chains.UUID != "client" || chains.Port != 80 {
+		t.Fatalf("read %+v, %v", chains, err)
+	}
+	tests := []struct {
+		name   string
+		chains string
+		reason string
+		status int
+	}{
+		{"missing", "", metrics.RejectMalformed, http.StatusBadRequest},
+		{"too large", `{"uuid":"` + strings.Repeat("a", 1024) + `"}`, metrics.RejectChainsSize, http.StatusRequestHeaderFieldsTooLarge},
+		{"not json", "{uuid", metrics.RejectMalformed, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		_, err := readChains(request(tt.chains))
+		var handshakeErr *HandshakeError
+		if !errors.As(err, &handshakeErr) || handshakeErr.Reason != tt.reason || handshakeErr.Status != tt.status {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// timeoutError A net.Error reporting a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRejectReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errors.WithStack(timeoutError{}), metrics.RejectRequestTimeout},
+		{errors.WithStack(io.EOF), ""},
+		{handshakeError(metrics.RejectChainsSize, http.StatusRequestHeaderFieldsTooLarge, io.ErrShortBuffer), metrics.RejectChainsSize},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := rejectReason(tt.err, metrics.RejectRequestTimeout); got != tt.want {
+			t.Errorf("rejectReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"github.com/ztalab/ZASentinel/pkg/recover"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopHeaders Headers of a single connection, not forwarded by the proxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ListenHTTPProxy Run an HTTP proxy on addr handling CONNECT and absolute-URI requests,
+// every destination is authorized against the resources of the client
+func (a *Client) ListenHTTPProxy(ctx context.Context, conf *schema.ClientConfig, addr string) error {
+	ln, err := listenTCP(ctx, "tcp", addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logger.WithContext(ctx).Printf("Started ZERO ACCESS Client HTTP proxy at %v\n", ln.Addr().String())
+	closeOnDone(ctx, ln)
+	for {
+		clientConn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logger.WithErrorStack(ctx, errors.WithStack(err)).Error("Failed to accept connection:", err)
+			continue
+		}
+		end := a.drainer.Begin()
+		recover.Recovery(ctx, func() {
+			defer end()
+			a.handleHTTPProxy(ctx, conf, clientConn)
+		})
+	}
+}
+
+// handleHTTPProxy Serve the requests of one proxy connection
+func (a *Client) handleHTTPProxy(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn) {
+	ctx = newTraceContext(ctx)
+	defer closeClientConn(ctx, clientConn)
+	br := bufio.NewReader(clientConn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				writeProxyError(clientConn, http.StatusBadRequest)
+			}
+			return
+		}
+		if req.Method == http.MethodConnect {
+			a.httpConnect(ctx, conf, &bufferedConn{Conn: clientConn, r: br}, req)
+			return
+		}
+		if !a.httpForward(ctx, conf, clientConn, req) {
+			return
+		}
+	}
+}
+
+// httpConnect Tunnel a CONNECT request
+func (a *Client) httpConnect(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn, req *http.Request) {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		writeProxyError(clientConn, http.StatusBadRequest)
+		return
+	}
+	target, err := proxyTarget(host, port)
+	if err != nil {
+		writeProxyError(clientConn, http.StatusBadRequest)
+		return
+	}
+	if target, err = a.verifyTarget(ctx, conf, schema.NetworkTCP, target); err != nil {
+		writeProxyError(clientConn, http.StatusForbidden)
+		return
+	}
+	stream, err := a.openStream(ctx, conf, &schema.StreamHeader{Network: schema.NetworkTCP, Target: &target, Source: clientConn.RemoteAddr().String()})
+	if err != nil {
+		writeProxyError(clientConn, http.StatusBadGateway)
+		logger.WithErrorStack(ctx, err).Errorf("The client failed to request the lower level service. Procedure:Error:%v", err)
+		return
+	}
+	defer stream.Close()
+	if _, err = io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	a.recordSession(ctx, conf, targetAddr(target), TransparentProxy(clientConn, stream))
+}
+
+// httpForward Forward an absolute-URI request over its own stream, reports whether the
+// proxy connection can serve another request
+func (a *Client) httpForward(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn, req *http.Request) bool {
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		writeProxyError(clientConn, http.StatusBadRequest)
+		return false
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	target, err := proxyTarget(req.URL.Hostname(), port)
+	if err != nil {
+		writeProxyError(clientConn, http.StatusBadRequest)
+		return false
+	}
+	if target, err = a.verifyTarget(ctx, conf, schema.NetworkTCP, target); err != nil {
+		writeProxyError(clientConn, http.StatusForbidden)
+		return false
+	}
+	stream, err := a.openStream(ctx, conf, &schema.StreamHeader{Network: schema.NetworkTCP, Target: &target, Source: clientConn.RemoteAddr().String()})
+	if err != nil {
+		writeProxyError(clientConn, http.StatusBadGateway)
+		logger.WithErrorStack(ctx, err).Errorf("The client failed to request the lower level service. Procedure:Error:%v", err)
+		return false
+	}
+	defer stream.Close()
+	begin := time.Now()
+	counted := &countingConn{Conn: stream}
+	result := &ProxyResult{Reason: CloseReasonServerClosed}
+	defer func() {
+		result.BytesUp, result.BytesDown, result.Duration = counted.written, counted.read, time.Since(begin)
+		a.recordSession(ctx, conf, targetAddr(target), result)
+	}()
+
+	keepAlive := !req.Close
+	removeHopHeaders(req.Header)
+	// One request per stream, the target closes after responding
+	req.Close = true
+	req.RequestURI = ""
+	if err = req.Write(counted); err != nil {
+		result.Reason = CloseReasonServerError
+		writeProxyError(clientConn, http.StatusBadGateway)
+		return false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(counted), req)
+	if err != nil {
+		result.Reason = CloseReasonServerError
+		writeProxyError(clientConn, http.StatusBadGateway)
+		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to read the response of %s: %v", req.URL.Host, err)
+		return false
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	resp.Close = !keepAlive
+	if err = resp.Write(clientConn); err != nil {
+		result.Reason = CloseReasonClientError
+		return false
+	}
+	return !resp.Close
+}
+
+// countingConn Count the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// proxyTarget Build the destination of a proxy request
+func proxyTarget(host, port string) (schema.Target, error) {
+	var target schema.Target
+	portInt, err := strconv.Atoi(port)
+	if err != nil || host == "" || portInt <= 0 || portInt > 65535 {
+		return target, errors.NewWithStack("Invalid proxy destination: " + net.JoinHostPort(host, port))
+	}
+	target.Host = host
+	target.Port = portInt
+	return target, nil
+}
+
+// removeHopHeaders Remove the hop-by-hop headers, including those listed in Connection
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// writeProxyError Send an empty error response and end the proxy connection
+func writeProxyError(w io.Writer, status int) {
+	_, _ = fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
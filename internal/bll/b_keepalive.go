@@ -0,0 +1,194 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"fmt"
+	"github.com/xtaci/smux"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"github.com/ztalab/ZASentinel/pkg/websocket"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func keepaliveInterval() time.Duration {
+	if config.C.Keepalive.Interval > 0 {
+		return time.Duration(config.C.Keepalive.Interval) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// keepaliveTimeout At least three intervals
+func keepaliveTimeout() time.Duration {
+	timeout := 30 * time.Second
+	if config.C.Keepalive.Timeout > 0 {
+		timeout = time.Duration(config.C.Keepalive.Timeout) * time.Second
+	}
+	if interval := keepaliveInterval(); timeout < 3*interval {
+		timeout = 3 * interval
+	}
+	return timeout
+}
+
+// tcpKeepAlive Period of the TCP keepalive probes as net.Dialer takes it, zero is the default and negative disables them
+func tcpKeepAlive() time.Duration {
+	if config.C.Keepalive.TCP < 0 {
+		return -1
+	}
+	return time.Duration(config.C.Keepalive.TCP) * time.Second
+}
+
+// smuxConfig Multiplexing of the tunnels, a session sends a NOP frame every interval and is
+// closed when nothing came from the peer within the timeout
+func smuxConfig() *smux.Config {
+	conf := smux.DefaultConfig()
+	conf.KeepAliveInterval = keepaliveInterval()
+	conf.KeepAliveTimeout = keepaliveTimeout()
+	return conf
+}
+
+// dialer Dialer of the tunnels and resources, with the dial timeout and TCP keepalive
+func dialer() *net.Dialer {
+	return &net.Dialer{Timeout: dialTimeout(), KeepAlive: tcpKeepAlive()}
+}
+
+// listenTCP Listen for the local connections of a client, with TCP keepalive
+func listenTCP(ctx context.Context, network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: tcpKeepAlive()}
+	return lc.Listen(ctx, network, address)
+}
+
+// setKeepAlive Enable TCP keepalive on an accepted connection as configured
+func setKeepAlive(conn *net.TCPConn) {
+	period := tcpKeepAlive()
+	if period < 0 {
+		_ = conn.SetKeepAlive(false)
+		return
+	}
+	if period == 0 {
+		period = 15 * time.Second
+	}
+	_ = conn.SetKeepAlive(true)
+	_ = conn.SetKeepAlivePeriod(period)
+}
+
+// sessionEndReason Why the multiplexed session of a tunnel ended, err is what AcceptStream returned.
+// A session closed here ends as one closed by the keepalive, callers tell them apart.
+func sessionEndReason(err error) string {
+	switch err {
+	case io.ErrClosedPipe:
+		return fmt.Sprintf("nothing received from the peer within %s", keepaliveTimeout())
+	case io.EOF, io.ErrUnexpectedEOF:
+		return "closed by the peer"
+	}
+	return err.Error()
+}
+
+// heartbeat Liveness of the websocket legs of a relay tunnel, which carry no keepalive the relay can see.
+// Both legs are pinged every interval, a leg from which nothing came within the timeout is dead and the
+// tunnel is torn down.
+type heartbeat struct {
+	ctx  context.Context
+	legs []*heartbeatConn
+	stop chan struct{}
+
+	mu     sync.Mutex
+	reason string
+}
+
+// heartbeatConn A leg of a relay tunnel, reading marks it alive
+type heartbeatConn struct {
+	*websocket.Conn
+	name string
+	last int64
+}
+
+func (c *heartbeatConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.alive()
+	}
+	return n, err
+}
+
+func (c *heartbeatConn) alive() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+// startHeartbeat Watch the client and server legs until Stop, the returned connections are proxied in
+// their place. Legs other than websocket connections are not watched.
+func startHeartbeat(ctx context.Context, clientConn, serverConn net.Conn) (*heartbeat, net.Conn, net.Conn) {
+	hb := &heartbeat{ctx: ctx, stop: make(chan struct{})}
+	watch := func(conn net.Conn, name string) net.Conn {
+		ws, ok := conn.(*websocket.Conn)
+		if !ok {
+			return conn
+		}
+		leg := &heartbeatConn{Conn: ws, name: name}
+		leg.alive()
+		ws.SetPongHandler(func([]byte) {
+			leg.alive()
+		})
+		hb.legs = append(hb.legs, leg)
+		return leg
+	}
+	clientConn = watch(clientConn, "client")
+	serverConn = watch(serverConn, "server")
+	if len(hb.legs) > 0 {
+		go hb.run()
+	}
+	return hb, clientConn, serverConn
+}
+
+func (a *heartbeat) run() {
+	interval, timeout := keepaliveInterval(), keepaliveTimeout()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, leg := range a.legs {
+			silent := time.Since(time.Unix(0, atomic.LoadInt64(&leg.last)))
+			if silent > timeout {
+				a.mu.Lock()
+				a.reason = CloseReasonHeartbeat
+				a.mu.Unlock()
+				logger.WithContext(a.ctx).Warnf("Heartbeat of the %s leg %s failed, nothing received for %s, tearing down the tunnel",
+					leg.name, leg.RemoteAddr().String(), silent.Round(time.Second))
+				// Unblock the proxy, closing is left to the caller
+				now := time.Now()
+				for _, item := range a.legs {
+					_ = item.SetDeadline(now)
+				}
+				return
+			}
+			// A failed ping shows as an error of the proxy
+			_ = leg.Ping(nil)
+		}
+	}
+}
+
+// Stop Stop watching, returns CloseReasonHeartbeat when a leg was found dead
+func (a *heartbeat) Stop() string {
+	close(a.stop)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reason
+}
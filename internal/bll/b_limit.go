@@ -0,0 +1,277 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/metrics"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"net"
+	"sync"
+	"time"
+)
+
+// Directions of the bandwidth limits, upload is from the clients to the resources
+const (
+	directionUpload   = "upload"
+	directionDownload = "download"
+)
+
+// Scopes of the bandwidth limits
+const (
+	limitGlobal   = "global"
+	limitClient   = "client"
+	limitResource = "resource"
+)
+
+// throttleReportInterval Least time between two throttle metrics of one side of a connection
+const throttleReportInterval = time.Second
+
+// tokenBucket Bytes per second with a burst of one second
+type tokenBucket struct {
+	scope string
+	id    string
+	// users Connections limited by the bucket, guarded by the mutex of the BandwidthLimiter
+	users int
+
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (a *tokenBucket) setRate(rate int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rate = rate
+	if a.tokens > float64(rate) {
+		a.tokens = float64(rate)
+	}
+}
+
+func (a *tokenBucket) currentRate() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rate
+}
+
+// allow Take one token if there is one, rate may change with the configuration
+func (a *tokenBucket) allow(rate int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.rate = rate
+	a.tokens += now.Sub(a.last).Seconds() * float64(a.rate)
+	a.last = now
+	if a.tokens > float64(a.rate) {
+		a.tokens = float64(a.rate)
+	}
+	if a.tokens < 1 {
+		return false
+	}
+	a.tokens--
+	return true
+}
+
+// full Whether the bucket refilled completely by now, a new bucket would take its place unnoticed
+func (a *tokenBucket) full(now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.tokens+now.Sub(a.last).Seconds()*float64(a.rate) >= float64(a.rate)
+}
+
+// reserve Take n bytes, returns how long to wait before they may be sent
+func (a *tokenBucket) reserve(n int) (time.Duration, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.tokens += now.Sub(a.last).Seconds() * float64(a.rate)
+	a.last = now
+	if a.tokens > float64(a.rate) {
+		a.tokens = float64(a.rate)
+	}
+	a.tokens -= float64(n)
+	if a.tokens >= 0 {
+		return 0, a.rate
+	}
+	return time.Duration(-a.tokens / float64(a.rate) * float64(time.Second)), a.rate
+}
+
+// BandwidthLimiter Token buckets of the bandwidth limits of a relay or server, shared by its connections
+type BandwidthLimiter struct {
+	operator string
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func NewBandwidthLimiter(operator string) *BandwidthLimiter {
+	return &BandwidthLimiter{operator: operator, buckets: make(map[string]*tokenBucket)}
+}
+
+// Limit Wrap the sides of a connection of clientUUID to resource, nil when it is not known here, so that
+// reading from clientConn waits for the upload limits and reading from serverConn for the download limits.
+// id and name identify the relay or server in the metrics. release is called once the connection ended.
+func (a *BandwidthLimiter) Limit(ctx context.Context, id, name, clientUUID string, resource *schema.Resource, clientConn, serverConn net.Conn) (net.Conn, net.Conn, func()) {
+	limits := config.C.Limit
+	client := limits.Clients[clientUUID]
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sweep(time.Now())
+	upload := a.collect(
+		a.bucket(limitGlobal, id, directionUpload, limits.Upload),
+		a.bucket(limitClient, clientUUID, directionUpload, client.Upload),
+	)
+	download := a.collect(
+		a.bucket(limitGlobal, id, directionDownload, limits.Download),
+		a.bucket(limitClient, clientUUID, directionDownload, client.Download),
+	)
+	if resource != nil {
+		upload = append(upload, a.collect(a.bucket(limitResource, resource.UUID, directionUpload, resource.UploadLimit))...)
+		download = append(download, a.collect(a.bucket(limitResource, resource.UUID, directionDownload, resource.DownloadLimit))...)
+	}
+	used := append(append([]*tokenBucket(nil), upload...), download...)
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			for _, bucket := range used {
+				bucket.users--
+			}
+		})
+	}
+	return a.wrap(ctx, id, name, directionUpload, clientConn, upload), a.wrap(ctx, id, name, directionDownload, serverConn, download), release
+}
+
+// bucket The bucket of a limit taken by one more connection, nil when it is unlimited
+func (a *BandwidthLimiter) bucket(scope, id, direction string, rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	key := scope + "/" + id + "/" + direction
+	bucket, ok := a.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			scope:  scope,
+			id:     id,
+			rate:   rate,
+			tokens: float64(rate),
+			last:   time.Now(),
+		}
+		a.buckets[key] = bucket
+	}
+	bucket.users++
+	// The limits of the resources may change with the configuration
+	bucket.setRate(rate)
+	return bucket
+}
+
+// sweep Forget the buckets no connection uses that refilled, at most once a second
+func (a *BandwidthLimiter) sweep(now time.Time) {
+	if now.Sub(a.swept) < time.Second {
+		return
+	}
+	a.swept = now
+	for key, bucket := range a.buckets {
+		if bucket.users <= 0 && bucket.full(now) {
+			delete(a.buckets, key)
+		}
+	}
+}
+
+func (a *BandwidthLimiter) collect(buckets ...*tokenBucket) []*tokenBucket {
+	var result []*tokenBucket
+	for _, bucket := range buckets {
+		if bucket != nil {
+			result = append(result, bucket)
+		}
+	}
+	return result
+}
+
+func (a *BandwidthLimiter) wrap(ctx context.Context, id, name, direction string, conn net.Conn, buckets []*tokenBucket) net.Conn {
+	if len(buckets) == 0 {
+		return conn
+	}
+	limited := &limitedConn{
+		Conn:      conn,
+		ctx:       ctx,
+		operator:  a.operator,
+		id:        id,
+		name:      name,
+		direction: direction,
+		buckets:   buckets,
+	}
+	// Datagrams cannot be split, reads of streams are kept within the smallest burst
+	if _, ok := conn.(net.PacketConn); !ok {
+		for _, bucket := range buckets {
+			if rate := int(bucket.currentRate()); limited.maxRead == 0 || rate < limited.maxRead {
+				limited.maxRead = rate
+			}
+		}
+	}
+	return limited
+}
+
+// limitedConn A connection whose reads wait for the bandwidth limits, read by one goroutine at a time
+type limitedConn struct {
+	net.Conn
+	ctx       context.Context
+	operator  string
+	id        string
+	name      string
+	direction string
+	buckets   []*tokenBucket
+	maxRead   int
+	waited    time.Duration
+	reported  time.Time
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.maxRead > 0 && len(p) > c.maxRead {
+		p = p[:c.maxRead]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.wait(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// wait Sleep until the n bytes read are within every limit, the longest wait is reported
+func (c *limitedConn) wait(n int) {
+	var wait time.Duration
+	var limiting *tokenBucket
+	var rate int64
+	for _, bucket := range c.buckets {
+		if d, r := bucket.reserve(n); d > wait {
+			wait, limiting, rate = d, bucket, r
+		}
+	}
+	if wait == 0 {
+		return
+	}
+	time.Sleep(wait)
+	c.waited += wait
+	if time.Since(c.reported) >= throttleReportInterval {
+		metrics.AddThrottlePoint(c.ctx, c.operator, c.direction, limiting.scope, limiting.id, c.waited.String(), rate, c.id, c.name)
+		c.waited = 0
+		c.reported = time.Now()
+	}
+}
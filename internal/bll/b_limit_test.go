@@ -0,0 +1,149 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bytes"
+	"context"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketAllow(t *testing.T) {
+	bucket := newRateBucket(3)
+	for i := 0; i < 3; i++ {
+		if !bucket.allow(3) {
+			t.Fatalf("token %d of the burst refused", i)
+		}
+	}
+	if bucket.allow(3) {
+		t.Fatal("a token beyond the burst was taken")
+	}
+	// A second refills the burst and no more
+	bucket.last = bucket.last.Add(-10 * time.Second)
+	for i := 0; i < 3; i++ {
+		if !bucket.allow(3) {
+			t.Fatalf("token %d after the refill refused", i)
+		}
+	}
+	if bucket.allow(3) {
+		t.Error("the refill exceeded the burst")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	bucket := &tokenBucket{rate: 1000, tokens: 1000, last: time.Now()}
+	if wait, rate := bucket.reserve(1000); wait != 0 || rate != 1000 {
+		t.Errorf("the burst waits %s at %d", wait, rate)
+	}
+	wait, _ := bucket.reserve(500)
+	if wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("500 bytes over the burst wait %s, want about 500ms", wait)
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	bucket := &tokenBucket{rate: 1000, tokens: 1000, last: time.Now()}
+	bucket.setRate(10)
+	if bucket.currentRate() != 10 || bucket.tokens != 10 {
+		t.Errorf("rate %d with %v tokens", bucket.currentRate(), bucket.tokens)
+	}
+	bucket.setRate(100)
+	if bucket.tokens != 10 {
+		t.Errorf("raising the rate granted tokens: %v", bucket.tokens)
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	bucket := newRateBucket(10)
+	now := time.Now()
+	if !bucket.full(now) {
+		t.Error("a new bucket is not full")
+	}
+	bucket.allow(10)
+	if bucket.full(now) {
+		t.Error("a bucket just used is full")
+	}
+	if !bucket.full(now.Add(time.Second)) {
+		t.Error("a bucket idle for a second is not full")
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	defer func(limit config.Limit) { config.C.Limit = limit }(config.C.Limit)
+	config.C.Limit = config.Limit{}
+	limiter := NewBandwidthLimiter("test")
+	clientConn, serverConn := &bufConn{}, &bufConn{}
+	up, down, _ := limiter.Limit(context.Background(), "relay", "relay", "client", nil, clientConn, serverConn)
+	if up != clientConn || down != serverConn {
+		t.Fatal("connections without limits were wrapped")
+	}
+
+	config.C.Limit.Clients = map[string]config.Bandwidth{"client": {Upload: 10000}}
+	resource := &schema.Resource{UUID: "db", DownloadLimit: 5000}
+	up, down, _ = limiter.Limit(context.Background(), "relay", "relay", "client", resource, clientConn, serverConn)
+	upLimited, ok := up.(*limitedConn)
+	if !ok || len(upLimited.buckets) != 1 || upLimited.maxRead != 10000 {
+		t.Fatalf("upload limited by %+v", up)
+	}
+	downLimited, ok := down.(*limitedConn)
+	if !ok || len(downLimited.buckets) != 1 || downLimited.maxRead != 5000 {
+		t.Fatalf("download limited by %+v", down)
+	}
+	// The connections of a client share its buckets
+	again, _, _ := limiter.Limit(context.Background(), "relay", "relay", "client", nil, clientConn, serverConn)
+	if again.(*limitedConn).buckets[0] != upLimited.buckets[0] {
+		t.Error("the connections of a client got their own bucket")
+	}
+
+	// 15000 bytes at 10000 per second with a burst of 10000 take half a second
+	upLimited.Conn = &bufConn{r: bytes.NewReader(make([]byte, 15000))}
+	begin := time.Now()
+	n, err := io.Copy(io.Discard, upLimited)
+	if err != nil || n != 15000 {
+		t.Fatal(n, err)
+	}
+	if elapsed := time.Since(begin); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("reading took %s, want about 500ms", elapsed)
+	}
+}
+
+func TestBandwidthLimiterForgetsIdle(t *testing.T) {
+	defer func(limit config.Limit) { config.C.Limit = limit }(config.C.Limit)
+	config.C.Limit = config.Limit{Clients: map[string]config.Bandwidth{"client": {Upload: 10000}}}
+	limiter := NewBandwidthLimiter("test")
+	sweep := func(after time.Duration) int {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		limiter.sweep(time.Now().Add(after))
+		return len(limiter.buckets)
+	}
+	up, _, release := limiter.Limit(context.Background(), "relay", "relay", "client", nil, &bufConn{}, &bufConn{})
+	if n := sweep(time.Minute); n != 1 {
+		t.Fatalf("%d buckets while a connection uses one", n)
+	}
+	// Drained, the bucket is kept until it refilled
+	up.(*limitedConn).buckets[0].reserve(20000)
+	release()
+	release()
+	limiter.swept = time.Time{}
+	if n := sweep(time.Second); n != 1 {
+		t.Fatalf("%d buckets, a drained one was forgotten", n)
+	}
+	limiter.swept = time.Time{}
+	if n := sweep(3 * time.Second); n != 0 {
+		t.Fatalf("%d buckets once the idle one refilled", n)
+	}
+}
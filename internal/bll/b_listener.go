@@ -0,0 +1,251 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// InheritedListenersEnv Environment variable naming the listening sockets a new binary inherits on upgrade,
+// addresses separated by ';' whose sockets are the inherited files from fd 3 on in the same order. The
+// further sockets of an address bound with SO_REUSEPORT are named with #1, #2 and so on appended.
+const InheritedListenersEnv = "ZAS_INHERITED_LISTENERS"
+
+// listeners The listening sockets of the relay or server, handed to the new binary on upgrade
+var listeners = &listenerSet{
+	active: make(map[string]*net.TCPListener),
+}
+
+type listenerSet struct {
+	mu        sync.Mutex
+	once      sync.Once
+	inherited map[string]*net.TCPListener
+	active    map[string]*net.TCPListener
+}
+
+// listen Listen for TCP on address, taking over the socket of the previous binary when it handed one over.
+// index numbers the sockets of the address, which are bound with SO_REUSEPORT when reusePort.
+func (a *listenerSet) listen(network, address string, index int, reusePort bool) (net.Listener, error) {
+	a.once.Do(a.inherit)
+	key := address
+	if index > 0 {
+		key += "#" + strconv.Itoa(index)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l, ok := a.inherited[key]
+	if ok {
+		delete(a.inherited, key)
+	} else {
+		var lc net.ListenConfig
+		if reusePort {
+			lc.Control = reusePortControl
+		}
+		ln, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		l = ln.(*net.TCPListener)
+	}
+	a.active[key] = l
+	return &trackedListener{TCPListener: l, set: a, key: key}, nil
+}
+
+// closeInherited Close the handed over sockets the configuration no longer listens on, the connections
+// queued on them would never be accepted
+func (a *listenerSet) closeInherited() {
+	a.once.Do(a.inherit)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, l := range a.inherited {
+		_ = l.Close()
+		delete(a.inherited, key)
+	}
+}
+
+// inherit Take the sockets named by InheritedListenersEnv, the variable is not passed on further
+func (a *listenerSet) inherit() {
+	a.inherited = make(map[string]*net.TCPListener)
+	value := os.Getenv(InheritedListenersEnv)
+	_ = os.Unsetenv(InheritedListenersEnv)
+	if value == "" {
+		return
+	}
+	for i, key := range strings.Split(value, ";") {
+		f := os.NewFile(uintptr(3+i), "listener "+key)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			continue
+		}
+		if l, ok := ln.(*net.TCPListener); ok {
+			a.inherited[key] = l
+		} else {
+			_ = ln.Close()
+		}
+	}
+}
+
+func (a *listenerSet) remove(key string, l *net.TCPListener) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.active[key] == l {
+		delete(a.active, key)
+	}
+}
+
+// ListenerFiles Duplicates of the listening sockets for a new binary, with the value of InheritedListenersEnv
+// naming them in order. The caller closes the files once the new binary started.
+func ListenerFiles() ([]*os.File, string, error) {
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	var files []*os.File
+	var keys []string
+	for key, l := range listeners.active {
+		f, err := l.File()
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+			return nil, "", errors.Wrapf(err, "failed to hand over the listener %s", key)
+		}
+		files = append(files, f)
+		keys = append(keys, key)
+	}
+	return files, strings.Join(keys, ";"), nil
+}
+
+// trackedListener A listener of the set, leaving it once closed
+type trackedListener struct {
+	*net.TCPListener
+	set *listenerSet
+	key string
+}
+
+// Accept Accept a connection with TCP keepalive as configured
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.TCPListener.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(conn)
+	return conn, nil
+}
+
+func (l *trackedListener) Close() error {
+	l.set.remove(l.key, l.TCPListener)
+	return l.TCPListener.Close()
+}
+
+// listenerConfigs The configured listeners with their defaults filled in, a single one on all IPv4 interfaces
+// at port when none is configured. unix is only accepted when allowUnix.
+func listenerConfigs(port int, allowUnix bool) ([]config.Listener, error) {
+	if len(config.C.Listeners) == 0 {
+		return []config.Listener{{Network: "tcp", Address: "0.0.0.0:" + strconv.Itoa(port)}}, nil
+	}
+	result := make([]config.Listener, 0, len(config.C.Listeners))
+	for _, item := range config.C.Listeners {
+		if item.Network == "" {
+			item.Network = "tcp"
+		}
+		switch item.Network {
+		case "tcp", "tcp4", "tcp6":
+			host, listenPort, err := net.SplitHostPort(item.Address)
+			if err != nil {
+				// A bare host or nothing at all
+				host, listenPort = strings.Trim(item.Address, "[]"), ""
+			}
+			if listenPort == "" || listenPort == "0" {
+				listenPort = strconv.Itoa(port)
+			}
+			item.Address = net.JoinHostPort(host, listenPort)
+		case "unix":
+			if !allowUnix {
+				return nil, errors.NewWithStack("unix listeners are only supported by clients: " + item.Address)
+			}
+			if item.Address == "" {
+				return nil, errors.NewWithStack("the unix listener has no socket path")
+			}
+		default:
+			return nil, errors.NewWithStack("unknown listener network: " + item.Network)
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// listenUnix Listen on the socket path, removing the socket a previous run left behind
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l, nil
+}
+
+// listenPeers Listen for the previous hops of a relay or server on the configured listeners, each with
+// acceptors sockets. The accepted connections are passed to dispatch by the accept loops until ctx is done.
+func listenPeers(ctx context.Context, role string, port int, dispatch func(conn net.Conn)) error {
+	items, err := listenerConfigs(port, false)
+	if err != nil {
+		return err
+	}
+	// Sockets of the previous binary left over once all listen
+	defer listeners.closeInherited()
+	count := acceptors()
+	for _, item := range items {
+		tlsConfig, err := listenerTLSConfig(item)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			l, err := listenTLS(item.Network, item.Address, i, count > 1, tlsConfig)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				logger.WithContext(ctx).Printf("Started ZERO ACCESS %s at %v\n", role, l.Addr().String())
+			}
+			closeOnDone(ctx, l)
+			go serveListener(ctx, l, dispatch)
+		}
+	}
+	return nil
+}
+
+// serveListener Accept on l until ctx is done and l closed, dispatch runs or queues the handling of each
+// connection without waiting for it
+func serveListener(ctx context.Context, l net.Listener, dispatch func(conn net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.WithContext(ctx).Infof("Stopped accepting connections at %v", l.Addr().String())
+				return
+			}
+			logger.WithErrorStack(ctx, errors.WithStack(err)).Error("Failed to accept connection:", err)
+			continue
+		}
+		dispatch(conn)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/event"
+	"github.com/ztalab/ZASentinel/internal/metrics"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states of a hop
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// pathSmoothing Weight of the latest sample in the smoothed RTT and success rate
+const pathSmoothing = 0.2
+
+// pathHop A hop the client can enter the chain through, a relay or the server directly
+type pathHop struct {
+	next     *schema.NextServer
+	name     string
+	isServer bool
+
+	mu       sync.Mutex
+	rtt      time.Duration
+	success  float64
+	failures int
+	breaker  string
+	openedAt time.Time
+	// trialUntil End of the trial dial of a half-open breaker, zero when none is in flight
+	trialUntil time.Time
+}
+
+// available Whether the hop may be tried, an open breaker turns half-open after the cooldown. A half-open
+// breaker lets one trial through, the next one once it was recorded or its time is up, trial being how long
+// a dial may take.
+func (a *pathHop) available(now time.Time, trial time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.breaker == breakerOpen && now.Sub(a.openedAt) >= breakerCooldown() {
+		a.breaker = breakerHalfOpen
+	}
+	switch a.breaker {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if now.Before(a.trialUntil) {
+			return false
+		}
+		a.trialUntil = now.Add(trial)
+	}
+	return true
+}
+
+// score Lower is better, hops never measured come after the measured ones
+func (a *pathHop) score() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rtt == 0 {
+		return float64(time.Hour)
+	}
+	success := a.success
+	if success < 0.05 {
+		success = 0.05
+	}
+	return float64(a.rtt) / success
+}
+
+// record Account the result of a probe or dial, rtt is zero when not measured.
+// Returns the event tag of a breaker transition, empty when there is none.
+func (a *pathHop) record(err error, rtt time.Duration) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.trialUntil = time.Time{}
+	if err == nil {
+		a.failures = 0
+		a.success = a.success*(1-pathSmoothing) + pathSmoothing
+		if rtt > 0 {
+			if a.rtt == 0 {
+				a.rtt = rtt
+			} else {
+				a.rtt = time.Duration(float64(a.rtt)*(1-pathSmoothing) + float64(rtt)*pathSmoothing)
+			}
+		}
+		if a.breaker != breakerClosed {
+			a.breaker = breakerClosed
+			return event.TagHopUp
+		}
+		return ""
+	}
+	a.failures++
+	a.success = a.success * (1 - pathSmoothing)
+	switch {
+	case a.breaker == breakerHalfOpen:
+		a.breaker = breakerOpen
+		a.openedAt = time.Now()
+	case a.breaker == breakerClosed && a.failures >= breakerThreshold():
+		a.breaker = breakerOpen
+		a.openedAt = time.Now()
+		return event.TagHopDown
+	}
+	return ""
+}
+
+func (a *pathHop) stats() (time.Duration, float64, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rtt, a.success, a.breaker
+}
+
+// PathSelector Rank the relays and the server by probed TLS handshake RTT and success rate,
+// skipping those whose circuit breaker is open
+type PathSelector struct {
+	conf *schema.ClientConfig
+	hops []*pathHop
+}
+
+func NewPathSelector(conf *schema.ClientConfig) *PathSelector {
+	selector := &PathSelector{conf: conf}
+	for _, item := range conf.Relays {
+		selector.hops = append(selector.hops, newPathHop(&schema.NextServer{
+			UUID: item.UUID,
+			Host: item.Host,
+			Port: strconv.Itoa(item.OutPort),
+		}, item.Name, false))
+	}
+	selector.hops = append(selector.hops, newPathHop(&schema.NextServer{
+		UUID: conf.Server.UUID,
+		Host: conf.Server.Host,
+		Port: strconv.Itoa(conf.Server.OutPort),
+	}, conf.Server.Name, true))
+	return selector
+}
+
+func newPathHop(next *schema.NextServer, name string, isServer bool) *pathHop {
+	return &pathHop{
+		next:     next,
+		name:     name,
+		isServer: isServer,
+		success:  1,
+		breaker:  breakerClosed,
+	}
+}
+
+// NextServers The hops to try in order: the available relays by rank, then the server directly.
+// When every breaker is open all hops are tried in chain order. server is the server entered
+// directly, the configured one when nil.
+func (a *PathSelector) NextServers(server *schema.Server) []*schema.NextServer {
+	now := time.Now()
+	trial := a.trialTimeout()
+	var relays []*pathHop
+	var direct *pathHop
+	for _, hop := range a.hops {
+		if !hop.available(now, trial) {
+			continue
+		}
+		if hop.isServer {
+			direct = hop
+		} else {
+			relays = append(relays, hop)
+		}
+	}
+	sort.SliceStable(relays, func(i, j int) bool {
+		return relays[i].score() < relays[j].score()
+	})
+	if direct != nil {
+		relays = append(relays, direct)
+	}
+	if len(relays) == 0 {
+		relays = a.hops
+	}
+	result := make([]*schema.NextServer, 0, len(relays))
+	for _, hop := range relays {
+		if hop.isServer && server != nil && server.UUID != hop.next.UUID {
+			// Another member of the server group
+			result = append(result, &schema.NextServer{
+				UUID: server.UUID,
+				Host: server.Host,
+				Port: strconv.Itoa(server.OutPort),
+			})
+			continue
+		}
+		result = append(result, hop.next)
+	}
+	return result
+}
+
+// trialTimeout How long a dial through the chain may take, every phase of the first hop and of the relays after it
+func (a *PathSelector) trialTimeout() time.Duration {
+	return dialTimeout() + tlsHandshakeTimeout() + requestTimeout() + tunnelReadyTimeout(len(a.conf.Relays))
+}
+
+// Report Account the result of a dial to next
+func (a *PathSelector) Report(ctx context.Context, next *schema.NextServer, err error) {
+	for _, hop := range a.hops {
+		if hop.next == next {
+			a.transition(ctx, hop, hop.record(err, 0), err)
+			return
+		}
+	}
+}
+
+// Run Probe all hops until ctx is done
+func (a *PathSelector) Run(ctx context.Context) {
+	interval := time.Duration(config.C.Client.ProbeInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, hop := range a.hops {
+			wg.Add(1)
+			go func(hop *pathHop) {
+				defer wg.Done()
+				a.probe(ctx, hop)
+			}(hop)
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe Measure the TLS handshake with a hop, its certificate is verified as on a real dial
+func (a *PathSelector) probe(ctx context.Context, hop *pathHop) {
+	timeout := time.Duration(config.C.Client.ProbeTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	begin := time.Now()
+	err := probeTLS(hop.next, timeout)
+	rtt := time.Since(begin)
+	if err != nil {
+		rtt = 0
+	}
+	a.transition(ctx, hop, hop.record(err, rtt), err)
+
+	status := metrics.ReqSuccess
+	if err != nil {
+		status = metrics.ReqFail
+	}
+	hopRTT, success, breaker := hop.stats()
+	metrics.AddPathPoint(ctx, status, hopRTT.String(), success, breaker, hop.next.UUID, hop.name, a.conf.UUID, a.conf.Name)
+}
+
+// transition Report a breaker transition of hop as an event
+func (a *PathSelector) transition(ctx context.Context, hop *pathHop, tag string, err error) {
+	if tag == "" {
+		return
+	}
+	kind := "Relay"
+	if hop.isServer {
+		kind = "Server"
+	}
+	msg := fmt.Sprintf("%s %s %s:%s", kind, hop.next.UUID, hop.next.Host, hop.next.Port)
+	if tag == event.TagHopDown {
+		if err != nil {
+			msg += " " + err.Error()
+		}
+		event.NewClientEvent(a.conf, tag, msg).Warn(ctx)
+		return
+	}
+	event.NewClientEvent(a.conf, tag, msg).Info(ctx)
+}
+
+func probeTLS(next *schema.NextServer, timeout time.Duration) error {
+	tlsConfig, err := DialTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig.VerifyPeerCertificate = VerifyPeer(next.UUID, "")
+	rawConn, err := net.DialTimeout("tcp", net.JoinHostPort(next.Host, next.Port), timeout)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_ = rawConn.SetDeadline(time.Now().Add(timeout))
+	conn := tls.Client(rawConn, tlsConfig)
+	defer conn.Close()
+	if err = conn.Handshake(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func breakerThreshold() int {
+	if config.C.Client.BreakerThreshold > 0 {
+		return config.C.Client.BreakerThreshold
+	}
+	return 3
+}
+
+func breakerCooldown() time.Duration {
+	if config.C.Client.BreakerCooldown > 0 {
+		return time.Duration(config.C.Client.BreakerCooldown) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// logFailover Log that a hop failed and the next one is tried
+func logFailover(ctx context.Context, next *schema.NextServer, err error) {
+	logger.WithErrorStack(ctx, err).Warnf("Failed to reach hop %s, trying the next one: %v", next.UUID, err)
+}
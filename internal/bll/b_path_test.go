@@ -0,0 +1,74 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"github.com/ztalab/ZASentinel/internal/event"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPathHopBreaker(t *testing.T) {
+	hop := newPathHop(&schema.NextServer{UUID: "relay"}, "relay", false)
+	refused := errors.New("refused")
+	var tag string
+	for i := 0; i < breakerThreshold(); i++ {
+		tag = hop.record(refused, 0)
+	}
+	if tag != event.TagHopDown || hop.available(time.Now(), time.Minute) {
+		t.Fatalf("the breaker did not open after %d failures", breakerThreshold())
+	}
+
+	// After the cooldown concurrent dials get a single trial
+	cooled := time.Now().Add(breakerCooldown())
+	var trials int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if hop.available(cooled, time.Minute) {
+				atomic.AddInt32(&trials, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if trials != 1 {
+		t.Fatalf("%d trials through the half-open breaker, want 1", trials)
+	}
+	// Another one once the trial is out of time
+	if !hop.available(cooled.Add(time.Minute), time.Minute) {
+		t.Fatal("no trial after the previous one ran out of time")
+	}
+	// A failed trial opens the breaker again
+	hop.record(refused, 0)
+	if hop.available(time.Now(), time.Minute) {
+		t.Fatal("the breaker stayed half-open after a failed trial")
+	}
+	cooled = time.Now().Add(breakerCooldown())
+	if !hop.available(cooled, time.Minute) {
+		t.Fatal("no trial after the cooldown")
+	}
+	// A successful one closes it, every dial goes through then
+	if tag = hop.record(nil, time.Millisecond); tag != event.TagHopUp {
+		t.Fatalf("a successful trial reported %q", tag)
+	}
+	for i := 0; i < 3; i++ {
+		if !hop.available(cooled, time.Minute) {
+			t.Fatal("the closed breaker refused a dial")
+		}
+	}
+}
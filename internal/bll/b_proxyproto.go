@@ -0,0 +1,362 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature First bytes of a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 commands and address families
+const (
+	proxyV2Local  = 0x20
+	proxyV2Proxy  = 0x21
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+// proxyV1MaxLen Longest PROXY protocol v1 header including CRLF
+const proxyV1MaxLen = 107
+
+// proxyTLV A TLV of a PROXY protocol v2 header
+type proxyTLV struct {
+	typ   byte
+	value string
+}
+
+// writeProxyHeader Send the PROXY protocol header of a connection from src to dst, version is v1 or v2.
+// The addresses are sent as unknown when either is not a TCP address, the TLVs are only sent by v2.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr, tlvs []proxyTLV) error {
+	srcAddr, _ := src.(*net.TCPAddr)
+	dstAddr, _ := dst.(*net.TCPAddr)
+	if srcAddr == nil || dstAddr == nil || srcAddr.IP.To16() == nil || dstAddr.IP.To16() == nil {
+		srcAddr, dstAddr = nil, nil
+	}
+	var buf bytes.Buffer
+	switch version {
+	case schema.ProxyProtocolV1:
+		switch {
+		case srcAddr != nil && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil:
+			fmt.Fprintf(&buf, "PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+		case srcAddr != nil && srcAddr.IP.To4() == nil && dstAddr.IP.To4() == nil:
+			fmt.Fprintf(&buf, "PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+		default:
+			// v1 cannot mix the families
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		}
+	case schema.ProxyProtocolV2:
+		family := byte(proxyV2Unspec)
+		var body []byte
+		if srcAddr != nil {
+			if src4, dst4 := srcAddr.IP.To4(), dstAddr.IP.To4(); src4 != nil && dst4 != nil {
+				family = proxyV2TCP4
+				body = append(body, src4...)
+				body = append(body, dst4...)
+			} else {
+				family = proxyV2TCP6
+				body = append(body, srcAddr.IP.To16()...)
+				body = append(body, dstAddr.IP.To16()...)
+			}
+			body = append(body, byte(srcAddr.Port>>8), byte(srcAddr.Port), byte(dstAddr.Port>>8), byte(dstAddr.Port))
+		}
+		for _, tlv := range tlvs {
+			if tlv.value == "" {
+				continue
+			}
+			body = append(body, tlv.typ, byte(len(tlv.value)>>8), byte(len(tlv.value)))
+			body = append(body, tlv.value...)
+		}
+		if len(body) > 0xFFFF {
+			return errors.NewWithStack("the PROXY protocol header is too long")
+		}
+		buf.Write(proxyV2Signature)
+		buf.WriteByte(proxyV2Proxy)
+		buf.WriteByte(family)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(body)))
+		buf.Write(body)
+	default:
+		return errors.NewWithStack("unknown PROXY protocol version: " + version)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// parseTCPAddr Parse host:port with an IP host, nil when it is not one
+func parseTCPAddr(address string) net.Addr {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNum)}
+}
+
+// readProxyHeader Read the PROXY protocol v1 or v2 header at the start of r. Returns the source address
+// it carries, nil when it carries none as with LOCAL, UNKNOWN or a family other than TCP.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		return readProxyHeaderV2(r)
+	}
+	return nil, errors.NewWithStack("the connection does not start with a PROXY protocol header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.NewWithStack("the PROXY protocol v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.NewWithStack("the PROXY protocol v1 header does not end with CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.NewWithStack("malformed PROXY protocol v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.NewWithStack("unknown PROXY protocol v1 protocol: " + fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.NewWithStack("malformed PROXY protocol v1 header")
+	}
+	src := parseTCPAddr(net.JoinHostPort(fields[2], fields[4]))
+	if src == nil {
+		return nil, errors.NewWithStack("malformed PROXY protocol v1 source address")
+	}
+	return src, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !bytes.Equal(head[:12], proxyV2Signature) {
+		return nil, errors.NewWithStack("malformed PROXY protocol v2 signature")
+	}
+	if head[12]>>4 != 2 {
+		return nil, errors.NewWithStack(fmt.Sprintf("unknown PROXY protocol version %d", head[12]>>4))
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch head[12] {
+	case proxyV2Local:
+		// Health checks of the load balancer itself
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, errors.NewWithStack(fmt.Sprintf("unknown PROXY protocol v2 command %d", head[12]&0x0F))
+	}
+	switch head[13] {
+	case proxyV2TCP4:
+		if len(body) < 12 {
+			return nil, errors.NewWithStack("short PROXY protocol v2 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), body[0:4]...)), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case proxyV2TCP6:
+		if len(body) < 36 {
+			return nil, errors.NewWithStack("short PROXY protocol v2 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), body[0:16]...)), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// listenTLS Listen for the mTLS connections of the previous hops on address, reading the PROXY
+// protocol headers of the load balancers first when configured. The socket is handed over on upgrade,
+// index and reusePort are those of listenerSet.listen.
+func listenTLS(network, address string, index int, reusePort bool, tlsConfig *tls.Config) (net.Listener, error) {
+	l, err := listeners.listen(network, address, index, reusePort)
+	if err != nil {
+		return nil, err
+	}
+	if config.C.ProxyProtocol.Accept {
+		// Any peer could choose its source address otherwise
+		if len(config.C.ProxyProtocol.Trusted) == 0 {
+			_ = l.Close()
+			return nil, errors.NewWithStack("PROXY protocol headers are accepted but no trusted CIDR is configured")
+		}
+		proxyListener := &proxyProtoListener{Listener: l}
+		for _, cidr := range config.C.ProxyProtocol.Trusted {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				_ = l.Close()
+				return nil, errors.Wrapf(err, "invalid PROXY protocol trusted CIDR %s", cidr)
+			}
+			proxyListener.trusted = append(proxyListener.trusted, ipNet)
+		}
+		return &proxyTLSListener{Listener: proxyListener, config: tlsConfig}, nil
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+// proxyProtoListener Wrap the connections from the load balancers so that their header is read
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{Conn: conn}, nil
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn A connection starting with a PROXY protocol header, read by readHeader in the handshake
+// worker so that the accepting goroutine never waits for it
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	mu     sync.Mutex
+	remote net.Addr
+}
+
+// proxyHeaderTimeout Time a load balancer has to send the PROXY protocol header
+func proxyHeaderTimeout() time.Duration {
+	if config.C.ProxyProtocol.HeaderTimeout > 0 {
+		return time.Duration(config.C.ProxyProtocol.HeaderTimeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// readHeader Read the header within proxyHeaderTimeout, before anything else reads from the connection
+func (c *proxyProtoConn) readHeader() error {
+	setPhaseDeadline(c.Conn, proxyHeaderTimeout())
+	r := bufio.NewReader(c.Conn)
+	remote, err := readProxyHeader(r)
+	setPhaseDeadline(c.Conn, 0)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.r = r
+	c.remote = remote
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	r := c.r
+	c.mu.Unlock()
+	if r == nil {
+		return 0, errors.NewWithStack("the PROXY protocol header was not read")
+	}
+	return r.Read(p)
+}
+
+// RemoteAddr The source address of the header once read, the load balancer before or when it carries none
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxyTLSListener Serve TLS over the connections of proxyProtoListener, keeping their header readable
+type proxyTLSListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *proxyTLSListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, l.config)
+	if proxyConn, ok := conn.(*proxyProtoConn); ok {
+		return &proxyTLSConn{Conn: tlsConn, proxy: proxyConn}, nil
+	}
+	return tlsConn, nil
+}
+
+// proxyTLSConn A TLS connection over a load balancer connection whose header is still to be read
+type proxyTLSConn struct {
+	*tls.Conn
+	proxy *proxyProtoConn
+}
+
+// acceptProxyHeader Read the PROXY protocol header of an accepted connection, before its TLS handshake.
+// Connections from untrusted sources carry none.
+func acceptProxyHeader(conn net.Conn) error {
+	proxyConn, ok := conn.(*proxyTLSConn)
+	if !ok {
+		return nil
+	}
+	return proxyConn.proxy.readHeader()
+}
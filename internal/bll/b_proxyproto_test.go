@@ -0,0 +1,195 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	v4Dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 443}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6000}
+	v6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	unix := &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		// want The source read back, nil when the header carries none
+		want map[string]*net.TCPAddr
+	}{
+		{"IPv4", v4, v4Dst, map[string]*net.TCPAddr{schema.ProxyProtocolV1: v4, schema.ProxyProtocolV2: v4}},
+		{"IPv6", v6, v6Dst, map[string]*net.TCPAddr{schema.ProxyProtocolV1: v6, schema.ProxyProtocolV2: v6}},
+		// v1 cannot mix the families, v2 sends IPv4 mapped into IPv6
+		{"mixed", v4, v6Dst, map[string]*net.TCPAddr{schema.ProxyProtocolV1: nil, schema.ProxyProtocolV2: v4}},
+		{"not TCP", unix, v4Dst, map[string]*net.TCPAddr{schema.ProxyProtocolV1: nil, schema.ProxyProtocolV2: nil}},
+	}
+	tlvs := []proxyTLV{{typ: 0xe0, value: "client-uuid"}, {typ: 0xe1}}
+	for _, tt := range tests {
+		for version, want := range tt.want {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, tt.src, tt.dst, tlvs); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("payload")
+			r := bufio.NewReader(&buf)
+			got, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.name, version, err)
+			}
+			if want == nil {
+				if got != nil {
+					t.Errorf("%s %s: read %v, want none", tt.name, version, got)
+				}
+			} else if tcp, ok := got.(*net.TCPAddr); !ok || !tcp.IP.Equal(want.IP) || tcp.Port != want.Port {
+				t.Errorf("%s %s: read %v, want %v", tt.name, version, got, want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("%s %s: the payload after the header became %q", tt.name, version, rest)
+			}
+		}
+	}
+}
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	var buf bytes.Buffer
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}
+	dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 443}
+	if err := writeProxyHeader(&buf, schema.ProxyProtocolV1, src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "PROXY TCP4 192.0.2.1 198.51.100.2 5000 443\r\n"; buf.String() != want {
+		t.Errorf("wrote %q, want %q", buf.String(), want)
+	}
+	if err := writeProxyHeader(&buf, "v3", src, dst, nil); err == nil {
+		t.Error("an unknown version was written")
+	}
+}
+
+func TestReadProxyHeaderV2Local(t *testing.T) {
+	header := append(append([]byte(nil), proxyV2Signature...), proxyV2Local, proxyV2Unspec, 0, 0)
+	got, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil || got != nil {
+		t.Errorf("LOCAL read %v, %v", got, err)
+	}
+}
+
+func TestReadProxyHeaderMalformed(t *testing.T) {
+	v2 := func(command, family byte, body ...byte) string {
+		header := append(append([]byte(nil), proxyV2Signature...), command, family, byte(len(body)>>8), byte(len(body)))
+		return string(append(header, body...))
+	}
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"empty", ""},
+		{"no header", "GET / HTTP/1.1\r\n"},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 198.51.100.2 5000 443\n"},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1"},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n"},
+		{"v1 protocol", "PROXY UDP4 192.0.2.1 198.51.100.2 5000 443\r\n"},
+		{"v1 fields", "PROXY TCP4 192.0.2.1 198.51.100.2 5000\r\n"},
+		{"v1 address", "PROXY TCP4 host 198.51.100.2 5000 443\r\n"},
+		{"v1 port", "PROXY TCP4 192.0.2.1 198.51.100.2 70000 443\r\n"},
+		{"v1 keyword", "PROXZ TCP4 192.0.2.1 198.51.100.2 5000 443\r\n"},
+		{"v2 signature", "\r\n\r\n\x00\r\nQUIZ\n\x21\x11\x00\x00"},
+		{"v2 truncated head", string(proxyV2Signature[:8])},
+		{"v2 version", v2(0x11, proxyV2TCP4, make([]byte, 12)...)},
+		{"v2 command", v2(0x22, proxyV2TCP4, make([]byte, 12)...)},
+		{"v2 short IPv4", v2(proxyV2Proxy, proxyV2TCP4, 1, 2, 3, 4)},
+		{"v2 short IPv6", v2(proxyV2Proxy, proxyV2TCP6, make([]byte, 20)...)},
+		{"v2 truncated body", v2(proxyV2Proxy, proxyV2TCP4, make([]byte, 12)...)[:20]},
+	}
+	for _, tt := range tests {
+		if got, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.header))); err == nil {
+			t.Errorf("%s: read %v", tt.name, got)
+		}
+	}
+}
+
+func TestProxyProtoConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &proxyProtoConn{Conn: local}
+	defer conn.Close()
+	// Nothing waits for the header before the handshake worker reads it
+	if got := conn.RemoteAddr(); got != local.RemoteAddr() {
+		t.Errorf("remote address before the header %s", got)
+	}
+	go func() {
+		src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4000}
+		dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+		_ = writeProxyHeader(remote, schema.ProxyProtocolV2, src, dst, nil)
+		_, _ = remote.Write([]byte("hello"))
+	}()
+	if err := acceptProxyHeader(&proxyTLSConn{Conn: tls.Server(conn, &tls.Config{}), proxy: conn}); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:4000" {
+		t.Errorf("remote address %s", got)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+func TestProxyProtoConnSilent(t *testing.T) {
+	defer func(timeout int) { config.C.ProxyProtocol.HeaderTimeout = timeout }(config.C.ProxyProtocol.HeaderTimeout)
+	config.C.ProxyProtocol.HeaderTimeout = 1
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &proxyProtoConn{Conn: local}
+	defer conn.Close()
+	begin := time.Now()
+	if err := conn.readHeader(); err == nil {
+		t.Fatal("read a header that was never sent")
+	}
+	if elapsed := time.Since(begin); elapsed > 3*time.Second {
+		t.Errorf("gave up on the header after %s", elapsed)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("read past a missing header")
+	}
+}
+
+func TestProxyProtoListenerTrusted(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	l := &proxyProtoListener{trusted: []*net.IPNet{lb}}
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1}, true},
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}, false},
+		{&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := l.isTrusted(tt.addr); got != tt.want {
+			t.Errorf("isTrusted(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	// Trusting nobody is not trusting everybody
+	if (&proxyProtoListener{}).isTrusted(&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3)}) {
+		t.Error("a listener without trusted CIDRs trusted a source")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"github.com/xtaci/smux"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"sync"
+)
+
+// Registry Servers registered with the relay in reverse-connect mode, keyed by server UUID
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string][]*smux.Session
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions: make(map[string][]*smux.Session),
+	}
+}
+
+// Register Add a session of a server, the newest registration is preferred
+func (a *Registry) Register(uuid string, session *smux.Session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sessions[uuid] = append(a.sessions[uuid], session)
+}
+
+// Unregister Remove a session of a server
+func (a *Registry) Unregister(uuid string, session *smux.Session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	sessions := a.sessions[uuid]
+	for key, item := range sessions {
+		if item == session {
+			sessions = append(sessions[:key], sessions[key+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(a.sessions, uuid)
+		return
+	}
+	a.sessions[uuid] = sessions
+}
+
+// IsRegistered Whether the server has a live registration
+func (a *Registry) IsRegistered(uuid string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, item := range a.sessions[uuid] {
+		if !item.IsClosed() {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenStream Open a stream to the server over its newest live registration
+func (a *Registry) OpenStream(uuid string) (*smux.Stream, error) {
+	a.mu.Lock()
+	sessions := make([]*smux.Session, len(a.sessions[uuid]))
+	copy(sessions, a.sessions[uuid])
+	a.mu.Unlock()
+	err := errors.NewWithStack("server " + uuid + " is not registered")
+	for key := len(sessions) - 1; key >= 0; key-- {
+		if sessions[key].IsClosed() {
+			continue
+		}
+		var stream *smux.Stream
+		stream, err = sessions[key].OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+		err = errors.WithStack(err)
+	}
+	return nil, err
+}
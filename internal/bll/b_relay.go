@@ -15,90 +15,94 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"github.com/xtaci/smux"
 	"github.com/ztalab/ZASentinel/internal/config"
 	"github.com/ztalab/ZASentinel/internal/contextx"
 	"github.com/ztalab/ZASentinel/internal/event"
+	"github.com/ztalab/ZASentinel/internal/initer"
 	"github.com/ztalab/ZASentinel/internal/metrics"
 	"github.com/ztalab/ZASentinel/internal/schema"
-	"github.com/ztalab/ZASentinel/pkg/certificate"
 	"github.com/ztalab/ZASentinel/pkg/errors"
 	"github.com/ztalab/ZASentinel/pkg/logger"
 	"github.com/ztalab/ZASentinel/pkg/pconst"
 	"github.com/ztalab/ZASentinel/pkg/recover"
-	"github.com/ztalab/ZASentinel/pkg/util/json"
+	"github.com/ztalab/ZASentinel/pkg/websocket"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
-	"strings"
 	"time"
 )
 
-type Relay struct{}
+type Relay struct {
+	registry  *Registry
+	limiter   *BandwidthLimiter
+	admission *AdmissionController
+	// balancers Balancers of the server groups of the clients certificates
+	balancers *BalancerSet
+	drainer   *Drainer
+	// handshakes Workers of the TLS handshakes, bound to the ctx of Listen
+	handshakes *HandshakePool
+	// ctx Context of Listen, the health checks of the balancers end with it
+	ctx context.Context
+}
+
+// registerPath Request path of servers registering in reverse-connect mode
+const registerPath = "/secretLink/register"
 
-// ReadInitiaWSRequest Receiving WS Requests
-func (a *Relay) ReadInitiaWSRequest(ctx context.Context, conf *schema.RelayConfig, connReader *bufio.Reader) (*schema.ClientConfig, *http.Request, context.Context, error) {
-	expectedH1Req := "GET /secretLink"
-	firstBytes, err := connReader.Peek(len(expectedH1Req))
+// ReadInitiaWSRequest Receiving WS Requests, limit caps the request line and headers
+func (a *Relay) ReadInitiaWSRequest(ctx context.Context, conf *schema.RelayConfig, connReader *bufio.Reader, limit *headerLimit) (*schema.ClientConfig, *http.Request, context.Context, error) {
+	if err := checkPreamble(connReader); err != nil {
+		return nil, nil, ctx, err
+	}
+	req, err := readRequest(connReader, limit)
 	if err != nil {
-		return nil, nil, ctx, errors.WithStack(err)
+		return nil, nil, ctx, err
 	}
-	if string(firstBytes) == expectedH1Req {
-		req, err := http.ReadRequest(connReader)
-		if err != nil {
-			return nil, nil, ctx, errors.WithStack(err)
-		}
-		traceID := req.Header.Get("X-TraceID")
-		if traceID != "" {
-			ctx = contextx.NewTraceID(ctx, traceID)
-			ctx = logger.NewTraceIDContext(ctx, traceID)
-		}
-		if strings.ToLower(req.Header.Get("Connection")) != "upgrade" && strings.ToLower(req.Header.Get("Connection")) != "keep-alive, upgrade" {
-			return nil, nil, ctx, errors.WithStack(fmt.Errorf("Connection header expected: upgrade, got: %s\n",
-				strings.ToLower(req.Header.Get("Connection"))))
-		}
-		if strings.ToLower(req.Header.Get("Upgrade")) != "websocket" {
-			return nil, nil, ctx, errors.WithStack(fmt.Errorf("Upgrade header expected: websocket, got: %s\n",
-				strings.ToLower(req.Header.Get("Upgrade"))))
-		}
-		chainsJSON := strings.ToLower(req.Header.Get("X-Chains"))
-		if chainsJSON == "" {
-			return nil, nil, ctx, errors.NewWithStack("X-Chains argument is missing")
-		}
-		var chains schema.ClientConfig
-		err = json.Unmarshal([]byte(chainsJSON), &chains)
-		if err != nil {
-			return nil, nil, ctx, errors.WithStack(err)
-		}
-		// get client cert
-		clientCa := req.Header.Get("X-ClientCert")
-		if clientCa == "" {
-			return nil, nil, ctx, errors.NewWithStack("X-ClientCert argument is missing")
-		}
-		clientCaCert, err := base64.StdEncoding.DecodeString(clientCa)
-		if err != nil {
-			return nil, nil, ctx, errors.WithStack(err)
-		}
-		// check client cert
-		err = certificate.NewVerify(string(clientCaCert), config.C.Certificate.CaPem, "").Verify()
-		if err != nil {
-			event.NewRelayEvent(&chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
-			return nil, nil, ctx, errors.WithStack(err)
+	traceID := req.Header.Get("X-TraceID")
+	if traceID != "" {
+		ctx = contextx.NewTraceID(ctx, traceID)
+		ctx = logger.NewTraceIDContext(ctx, traceID)
+	}
+	if err = websocket.CheckRequest(req); err != nil {
+		return nil, nil, ctx, handshakeError(metrics.RejectMalformed, http.StatusBadRequest, fmt.Errorf("%v, Connection: %s, Upgrade: %s",
+			err, req.Header.Get("Connection"), req.Header.Get("Upgrade")))
+	}
+	chains, err := readChains(req)
+	if err != nil {
+		return nil, nil, ctx, err
+	}
+	// check previous relay cert
+	if req.Header.Get("X-RelayCert") != "" {
+		if _, err = headerCert(req, "X-RelayCert"); err != nil {
+			event.NewRelayEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+			return nil, nil, ctx, err
 		}
-		return &chains, req, ctx, nil
 	}
-	req, err := http.ReadRequest(connReader)
+	// check client cert
+	clientCert, err := headerCert(req, "X-ClientCert")
 	if err != nil {
-		return nil, nil, ctx, errors.WithStack(err)
+		event.NewRelayEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+		return nil, nil, ctx, err
 	}
-	reqBytes, err := httputil.DumpRequest(req, false)
+	// The identity, relays and server group come from the verified certificate, X-Chains only names
+	// the member of the group the client picked and the target
+	grant, err := clientGrant(clientCert)
 	if err != nil {
-		return nil, nil, ctx, errors.WithStack(err)
+		event.NewRelayEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+		return nil, nil, ctx, err
+	}
+	for _, item := range grant.ServerMembers() {
+		if item.UUID == chains.Server.UUID {
+			grant.Server = item
+		}
 	}
-	err = errors.New("Reply Illegal request:\n" + string(reqBytes))
-	return nil, nil, ctx, errors.WithStack(err)
+	grant.Target = chains.Target
+	return grant, req, ctx, nil
 }
 
 // Responding to WS requests
@@ -119,9 +123,7 @@ func (a *Relay) GenerateInitialWSResponse(ctx context.Context, clientConn net.Co
 		Request:          nil,
 		TLS:              nil,
 	}
-	resp.Header.Set("Upgrade", req.Header.Get("Upgrade"))
-	resp.Header.Set("Connection", req.Header.Get("Connection"))
-	resp.Header.Set("X-ServerCert", base64.StdEncoding.EncodeToString([]byte(config.C.Certificate.CertPem)))
+	websocket.SetResponseHeaders(&resp, req)
 
 	res, err := httputil.DumpResponse(&resp, true)
 	_, err = clientConn.Write(res)
@@ -131,145 +133,363 @@ func (a *Relay) GenerateInitialWSResponse(ctx context.Context, clientConn net.Co
 	return res, err
 }
 
-func (a *Relay) handleConn(ctx context.Context, conf *schema.RelayConfig, clientConn net.Conn) error {
+// handshake Complete the TLS handshake of an accepted connection in a worker of the handshake pool,
+// the connection is then served in its own goroutine
+func (a *Relay) handshake(ctx context.Context, conf *schema.RelayConfig, clientConn net.Conn) {
+	begin := time.Now()
+	err := acceptProxyHeader(clientConn)
+	if err != nil {
+		_ = clientConn.Close()
+		metrics.AddRejectPoint(ctx, pconst.OperatorRelay, metrics.RejectProxyHeader, clientConn.RemoteAddr().String(), conf.UUID, conf.Name)
+		logger.WithErrorStack(ctx, err).Error("PROXY protocol header error：", err)
+		return
+	}
+	releaseHandshake, err := a.admission.Handshake(clientConn.RemoteAddr())
+	if err != nil {
+		_ = clientConn.Close()
+		event.NewRelayEvent(nil, conf, event.TagAdmissionReject, err.Error()).Warn(ctx)
+		return
+	}
+	peer, err := peerCertificate(clientConn)
+	releaseHandshake()
+	if err != nil {
+		_ = clientConn.Close()
+		metrics.AddRejectPoint(ctx, pconst.OperatorRelay, metrics.RejectTLS, clientConn.RemoteAddr().String(), conf.UUID, conf.Name)
+		metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+		logger.WithErrorStack(ctx, err).Error("TLS handshake error：", err)
+		return
+	}
+	recover.Recovery(ctx, func() {
+		_ = a.handleConn(ctx, conf, clientConn, peer)
+	})
+}
+
+// handleConn Serve a connection of the previous hop, which authenticated with the peer certificate
+func (a *Relay) handleConn(ctx context.Context, conf *schema.RelayConfig, clientConn net.Conn, peer *x509.Certificate) error {
 	begin := time.Now()
+	// Replaced by the websocket connection once upgraded, so that closing sends a close frame
+	closer := net.Conn(clientConn)
 	defer func() {
-		closeErr := clientConn.Close()
+		closeErr := closer.Close()
 		if closeErr != nil {
 			logger.WithErrorStack(ctx, errors.WithStack(closeErr)).Errorf("Closed Connection with error: %v\n", closeErr)
 		} else {
 			logger.WithContext(ctx).Infof("Closed Connection: %v\n", clientConn.RemoteAddr().String())
 		}
 	}()
-	connReader := bufio.NewReader(clientConn)
-	chains, req, ctx, err := a.ReadInitiaWSRequest(ctx, conf, connReader)
+	// The request must arrive in time and within the header limit
+	setPhaseDeadline(clientConn, requestTimeout())
+	limit := newHeaderLimit(clientConn)
+	connReader := bufio.NewReader(limit)
+	// Health probes of the clients close right after the handshake
+	if _, err := connReader.Peek(1); err != nil {
+		if err != io.EOF {
+			rejectHandshake(ctx, pconst.OperatorRelay, clientConn, err, metrics.RejectRequestTimeout, conf.UUID, conf.Name)
+		}
+		return nil
+	}
+	if err := checkPreamble(connReader); err != nil {
+		rejectHandshake(ctx, pconst.OperatorRelay, clientConn, err, metrics.RejectRequestTimeout, conf.UUID, conf.Name)
+		logger.WithErrorStack(ctx, err).Error("Error obtaining WS request information：", err)
+		return err
+	}
+	// Servers in reverse-connect mode register on the same listener
+	expectedRegister := "GET " + registerPath + " "
+	if firstBytes, _ := connReader.Peek(len(expectedRegister)); string(firstBytes) == expectedRegister {
+		release, err := a.admission.Admit(peerIdentity(peer))
+		if err != nil {
+			rejectConn(clientConn, err.(*AdmissionError))
+			event.NewRelayEvent(nil, conf, event.TagAdmissionReject, err.Error()).Warn(ctx)
+			return err
+		}
+		defer release()
+		return a.handleRegister(ctx, conf, clientConn, connReader, limit, peer)
+	}
+	chains, req, ctx, err := a.ReadInitiaWSRequest(ctx, conf, connReader, limit)
 	if err != nil {
+		rejectHandshake(ctx, pconst.OperatorRelay, clientConn, err, metrics.RejectRequestTimeout, conf.UUID, conf.Name)
 		metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 		logger.WithErrorStack(ctx, err).Error("Error obtaining WS request information：", err)
 		return err
 	}
+	// The previous hop must own the certificate it announced
+	client, err := verifyHopCert(peer, req)
+	if err != nil {
+		metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+		event.NewRelayEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+		logger.WithErrorStack(ctx, err).Error("Previous hop certificate error：", err)
+		return err
+	}
+	// The limits apply to the verified client, not to the relay before this one
+	release, err := a.admission.Admit(peerIdentity(client))
+	if err != nil {
+		rejectConn(clientConn, err.(*AdmissionError))
+		event.NewRelayEvent(chains, conf, event.TagAdmissionReject, err.Error()).Warn(ctx)
+		return err
+	}
+	defer release()
+	setPhaseDeadline(clientConn, writeTimeout())
 	_, err = a.GenerateInitialWSResponse(ctx, clientConn, req)
 	if err != nil {
+		rejectHandshake(ctx, pconst.OperatorRelay, clientConn, err, metrics.RejectWriteTimeout, conf.UUID, conf.Name)
 		metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 		logger.WithErrorStack(ctx, err).Error("Response WS message error：", err)
 		return err
 	}
 	// Get server certificate verification information
 	verifyFlag := "serverCaReady"
-	verifyBytes, err := connReader.Peek(len(verifyFlag))
+	wsConn := websocket.NewConn(clientConn, connReader, false)
+	closer = wsConn
+	verifyBytes := make([]byte, len(verifyFlag))
+	setPhaseDeadline(clientConn, readyTimeout())
+	_, err = io.ReadFull(wsConn, verifyBytes)
+	setPhaseDeadline(clientConn, 0)
 	if err != nil {
+		rejectHandshake(ctx, pconst.OperatorRelay, clientConn, err, metrics.RejectReadyTimeout, conf.UUID, conf.Name)
 		metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 		logger.WithErrorStack(ctx, err).Error("Error obtaining the certificate verification result：", err)
 		return err
 	}
 	// Server certificate verification passed
 	if string(verifyBytes) == verifyFlag {
-		nextServer := a.GetNextServer(conf, chains)
+		balancer, releaseBalancer := a.balancer(conf, chains)
+		defer releaseBalancer()
+		nextServer := a.GetNextServer(conf, chains, balancer)
 		serverConn, err := a.DialWS(ctx, nextServer, req, conf, chains)
+		// Fail over to the next healthy member of the server group
+		if balancer != nil {
+			tried := make(map[string]bool)
+			for err != nil {
+				next := balancer.Failover(nextServer.UUID, err, tried)
+				if next == nil {
+					break
+				}
+				logFailover(ctx, nextServer, err)
+				nextServer = next
+				serverConn, err = a.DialWS(ctx, nextServer, req, conf, chains)
+			}
+		}
 		if err != nil {
 			metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 			logger.WithErrorStack(ctx, err).Errorf("The relay side failed to request the lower-level service:Addr:%s:%s Error:%v", nextServer.Host, nextServer.Port, err)
 			return err
 		}
 		defer serverConn.Close()
+		if balancer != nil {
+			defer balancer.Acquire(nextServer.UUID)()
+		}
+		// Tunnels end when the client or the server closes them
+		defer a.drainer.Begin()()
+		// On shutdown the client opens its next streams on a new tunnel and closes this one once they ended
+		defer goAwayOnDone(ctx, wsConn)()
+		// So it does when the server shuts down, the client only sees the legs of this relay
+		if serverWS, ok := serverConn.(*websocket.Conn); ok {
+			serverWS.SetPingHandler(func(appData []byte) {
+				if isGoAway(appData) {
+					_ = wsConn.Ping(goAwayPing)
+				}
+			})
+		}
 		event.NewRelayEvent(chains, conf, event.TagConnectSuccess, "").Info(ctx)
 		end := time.Now().Sub(begin).String()
 		metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqSuccess, end, conf.UUID, conf.Name)
-		TransparentProxy(clientConn, serverConn)
+		// The resource is only known to the server, the relay enforces the global limits and those of the
+		// verified client identity
+		// The legs are only relayed, the heartbeat tears the tunnel down when either peer is gone
+		hb, clientLeg, serverLeg := startHeartbeat(ctx, wsConn, serverConn)
+		clientSide, serverSide, releaseLimits := a.limiter.Limit(ctx, conf.UUID, conf.Name, peerIdentity(client), nil, clientLeg, serverLeg)
+		defer releaseLimits()
+		result := TransparentProxy(clientSide, serverSide)
+		if reason := hb.Stop(); reason != "" {
+			result.Reason = reason
+		}
+		// The relay only sees the whole tunnel session, its streams are end-to-end encrypted
+		target := ""
+		if chains.Target.Host != "" {
+			target = targetAddr(chains.Target)
+		}
+		recordSession(ctx, event.NewRelayEvent(chains, conf, event.TagDisconnect, ""), chains.UUID, target, "", result, conf.UUID, conf.Name)
 		return nil
 	}
 	err = errors.New("Relay side certificate verification failed\n")
 	logger.WithErrorStack(ctx, errors.WithStack(err)).Error(err)
+	metrics.AddRejectPoint(ctx, pconst.OperatorRelay, metrics.RejectMalformed, clientConn.RemoteAddr().String(), conf.UUID, conf.Name)
 	metrics.AddDelayPoint(ctx, pconst.OperatorRelay, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 	return err
 }
 
-func (a *Relay) DialWS(ctx context.Context, nextChain *schema.NextServer, req *http.Request, conf *schema.RelayConfig, chains *schema.ClientConfig) (net.Conn, error) {
-	conn, err := tls.Dial("tcp", nextChain.Host+":"+nextChain.Port, &tls.Config{InsecureSkipVerify: true})
+// handleRegister Keep the multiplexed registration of a server in reverse-connect mode until it ends.
+// Client streams toward the server are opened over it.
+func (a *Relay) handleRegister(ctx context.Context, conf *schema.RelayConfig, serverConn net.Conn, connReader *bufio.Reader, limit *headerLimit, peer *x509.Certificate) error {
+	req, err := readRequest(connReader, limit)
 	if err != nil {
-		event.NewRelayEvent(chains, conf, event.TagConnectFail, err.Error()).Error(ctx)
-		return nil, errors.WithStack(err)
+		rejectHandshake(ctx, pconst.OperatorRelay, serverConn, err, metrics.RejectRequestTimeout, conf.UUID, conf.Name)
+		return err
 	}
-	req.Host = nextChain.Host
-	req.Header.Set("X-ClientCert", base64.StdEncoding.EncodeToString([]byte(config.C.Certificate.CertPem)))
-
-	err = req.Write(conn)
+	if traceID := req.Header.Get("X-TraceID"); traceID != "" {
+		ctx = contextx.NewTraceID(ctx, traceID)
+		ctx = logger.NewTraceIDContext(ctx, traceID)
+	}
+	if err = websocket.CheckRequest(req); err != nil {
+		err = handshakeError(metrics.RejectMalformed, http.StatusBadRequest, err)
+		rejectHandshake(ctx, pconst.OperatorRelay, serverConn, err, metrics.RejectRequestTimeout, conf.UUID, conf.Name)
+		return err
+	}
+	attrs, err := peerAttrs(peer)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return err
+	}
+	serverUUID, _ := attrs["uuid"].(string)
+	if attrs["type"] != initer.TypeServer || serverUUID == "" {
+		err = errors.NewWithStack("Only servers can register with the relay")
+		event.NewRelayEvent(nil, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+		return err
 	}
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	setPhaseDeadline(serverConn, writeTimeout())
+	_, err = a.GenerateInitialWSResponse(ctx, serverConn, req)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		rejectHandshake(ctx, pconst.OperatorRelay, serverConn, err, metrics.RejectWriteTimeout, conf.UUID, conf.Name)
+		return err
+	}
+	// The session keepalive takes over
+	setPhaseDeadline(serverConn, 0)
+	session, err := smux.Client(websocket.NewConn(serverConn, connReader, false), smuxConfig())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer session.Close()
+	a.registry.Register(serverUUID, session)
+	defer a.registry.Unregister(serverUUID, session)
+	event.NewRelayEvent(nil, conf, event.TagServerRegister, serverUUID).Info(ctx)
+	// The server never opens streams, AcceptStream only returns once the session is dead
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.WithContext(ctx).Warnf("Registration of server %s ended: %s", serverUUID, sessionEndReason(err))
+			}
+			break
+		}
+		_ = stream.Close()
 	}
+	event.NewRelayEvent(nil, conf, event.TagServerUnregister, serverUUID).Warn(ctx)
+	return nil
+}
 
-	if resp.Status == "101 Switching Protocols" &&
-		strings.ToLower(resp.Header.Get("Upgrade")) == "websocket" &&
-		strings.ToLower(resp.Header.Get("Connection")) == "upgrade" {
-		// Get server certificate
-		serverCa := resp.Header.Get("X-ServerCert")
-		if resp.Header.Get("X-ServerCert") == "" {
-			err = errors.New("Failed to obtain lower-level service certificate")
-			return nil, errors.WithStack(err)
+// DialWS Dial the tunnel to the next hop of chains, every phase has a deadline so that a next hop that stopped
+// answering fails the dial
+func (a *Relay) DialWS(ctx context.Context, nextChain *schema.NextServer, req *http.Request, conf *schema.RelayConfig, chains *schema.ClientConfig) (net.Conn, error) {
+	tlsConfig, err := DialTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if a.registry.IsRegistered(nextChain.UUID) {
+		// The server registered in reverse-connect mode, its identity was verified at registration
+		conn, err = a.registry.OpenStream(nextChain.UUID)
+		if err != nil {
+			event.NewRelayEvent(chains, conf, event.TagConnectFail, err.Error()).Error(ctx)
+			return nil, err
 		}
-		serverCaCert, err := base64.StdEncoding.DecodeString(serverCa)
+	} else {
+		// The next hop must be the relay or server expected by the chain
+		tlsConfig.VerifyPeerCertificate = VerifyPeer(nextChain.UUID, "")
+		rawConn, err := dialer().DialContext(ctx, "tcp", nextChain.Host+":"+nextChain.Port)
 		if err != nil {
+			event.NewRelayEvent(chains, conf, event.TagConnectFail, err.Error()).Error(ctx)
 			return nil, errors.WithStack(err)
 		}
-		// Verify server certificate
-		err = certificate.NewVerify(string(serverCaCert), config.C.Certificate.CaPem, nextChain.Host).Verify()
-		if err != nil {
+		tlsConn := tls.Client(rawConn, tlsConfig)
+		setPhaseDeadline(tlsConn, tlsHandshakeTimeout())
+		if err = tlsConn.Handshake(); err != nil {
+			_ = tlsConn.Close()
 			event.NewRelayEvent(chains, conf, event.TagServerTLSFail, err.Error()).Error(ctx)
 			return nil, errors.WithStack(err)
 		}
-		_, err = conn.Write([]byte("serverCaReady"))
+		conn = tlsConn
+	}
+	wsConn, err := a.upgrade(conn, nextChain, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	setPhaseDeadline(conn, 0)
+	return wsConn, nil
+}
+
+// upgrade Forward the websocket request of the client to the next hop over conn
+func (a *Relay) upgrade(conn net.Conn, nextChain *schema.NextServer, req *http.Request) (net.Conn, error) {
+	req.Host = nextChain.Host
+	// Every hop negotiates its own websocket key
+	wsKey, err := websocket.SetRequestHeaders(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// The client certificate is forwarded untouched, the relay identifies itself separately
+	req.Header.Set("X-RelayCert", base64.StdEncoding.EncodeToString([]byte(config.C.Certificate.CertPem)))
+
+	setPhaseDeadline(conn, requestTimeout())
+	err = req.Write(conn)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	connReader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(connReader, req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	wsErr := websocket.CheckResponse(resp, wsKey)
+	if wsErr == nil {
+		wsConn := websocket.NewConn(conn, connReader, true)
+		setPhaseDeadline(conn, writeTimeout())
+		_, err = wsConn.Write([]byte("serverCaReady"))
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
-		return conn, nil
+		return wsConn, nil
 	}
 	respBytes, err := httputil.DumpResponse(resp, false)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	err = errors.New("Got unexpected response:\n" + string(respBytes) + "\nstatus:" + resp.Status)
+	err = errors.Wrap(wsErr, "Got unexpected response:\n"+string(respBytes)+"\nstatus:"+resp.Status)
 	return nil, errors.WithStack(err)
 }
 
 func NewRelay() *Relay {
-	return &Relay{}
+	return &Relay{
+		registry:  NewRegistry(),
+		limiter:   NewBandwidthLimiter(pconst.OperatorRelay),
+		admission: NewAdmissionController(),
+		balancers: NewBalancerSet(),
+		drainer:   NewDrainer(),
+	}
 }
 
-func (a *Relay) Listen(ctx context.Context, attrs map[string]interface{}) {
-	go func() {
-		conf, err := schema.ParseRelayConfig(attrs)
-		if err != nil {
-			panic(err)
-		}
-		cert, err := tls.X509KeyPair([]byte(config.C.Certificate.CertPem), []byte(config.C.Certificate.KeyPem))
-		if err != nil {
-			panic(err)
-		}
-		l, err := tls.Listen("tcp", "0.0.0.0:"+strconv.Itoa(conf.Port), &tls.Config{
-			Certificates: []tls.Certificate{cert},
+// Listen Serve the previous hops until ctx is done, returns once the listeners are open
+func (a *Relay) Listen(ctx context.Context, attrs map[string]interface{}) error {
+	a.ctx = ctx
+	conf, err := schema.ParseRelayConfig(attrs)
+	if err != nil {
+		return err
+	}
+	a.handshakes = NewHandshakePool(ctx)
+	return listenPeers(ctx, "Relay", conf.Port, func(conn net.Conn) {
+		a.handshakes.Dispatch(conn, func(conn net.Conn) {
+			a.handshake(ctx, conf, conn)
 		})
-		if err != nil {
-			panic(err)
-		}
-		logger.WithContext(ctx).Printf("Started ZERO ACCESS Relay at %v\n", l.Addr().String())
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				logger.WithErrorStack(ctx, errors.WithStack(err)).Error("Failed to accept connection:", err)
-				continue
-			}
-			recover.Recovery(ctx, func() {
-				a.handleConn(ctx, conf, conn)
-			})
-		}
-	}()
+	})
 }
 
-func (a *Relay) GetNextServer(conf *schema.RelayConfig, chains *schema.ClientConfig) *schema.NextServer {
+// Drain Wait for the tunnels in flight once Listen stopped accepting
+func (a *Relay) Drain(ctx context.Context) {
+	a.drainer.Drain(ctx, drainTimeout())
+}
+
+// GetNextServer The next relay of the chain or, from the last relay, the server. balancer picks the server
+// when the client has a server group.
+func (a *Relay) GetNextServer(conf *schema.RelayConfig, chains *schema.ClientConfig, balancer *ServerBalancer) *schema.NextServer {
 	replyCount := len(chains.Relays)
 	nextKey := 0
 	for key, item := range chains.Relays {
@@ -283,12 +503,51 @@ func (a *Relay) GetNextServer(conf *schema.RelayConfig, chains *schema.ClientCon
 	}
 	nextServer := new(schema.NextServer)
 	if nextKey == 0 {
+		// A healthy member of the server group, the one picked by the client if possible
+		if balancer != nil {
+			if member := balancer.Pick(chains.Server.UUID); member != nil {
+				return member
+			}
+		}
+		nextServer.UUID = chains.Server.UUID
 		nextServer.Host = chains.Server.Host
 		nextServer.Port = strconv.Itoa(chains.Server.OutPort)
 	} else {
 		chain := chains.Relays[nextKey]
+		nextServer.UUID = chain.UUID
 		nextServer.Host = chain.Host
 		nextServer.Port = strconv.Itoa(chain.OutPort)
 	}
 	return nextServer
 }
+
+// balancer The balancer of the server group of chains when this relay is the last hop, nil without a group.
+// chains is the verified configuration of the client. The balancer is held by the tunnel until release.
+func (a *Relay) balancer(conf *schema.RelayConfig, chains *schema.ClientConfig) (*ServerBalancer, func()) {
+	if chains.ServerGroup == nil || len(chains.ServerGroup.Servers) == 0 {
+		return nil, func() {}
+	}
+	if len(chains.Relays) > 0 && chains.Relays[len(chains.Relays)-1].UUID != conf.UUID {
+		return nil, func() {}
+	}
+	ctx := a.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return a.balancers.Acquire(ctx, chains.ServerGroup, func() *ServerBalancer {
+		return NewServerBalancer(chains.ServerGroup, func(next *schema.NextServer, healthy bool, err error) {
+			msg := fmt.Sprintf("Server %s %s:%s", next.UUID, next.Host, next.Port)
+			if !healthy {
+				event.NewRelayEvent(nil, conf, event.TagHopDown, msg+" "+err.Error()).Warn(ctx)
+				return
+			}
+			event.NewRelayEvent(nil, conf, event.TagHopUp, msg).Info(ctx)
+		})
+	}, func(next *schema.NextServer) error {
+		// A server in reverse-connect mode is healthy while registered
+		if a.registry.IsRegistered(next.UUID) {
+			return nil
+		}
+		return probeTLS(next, healthTimeout())
+	})
+}
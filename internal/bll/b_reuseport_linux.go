@@ -0,0 +1,36 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package bll
+
+import (
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// reusePortControl Set SO_REUSEPORT before binding, the kernel then spreads the connections over the sockets of the address
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if sockErr != nil {
+		return errors.Wrap(sockErr, "failed to set SO_REUSEPORT")
+	}
+	return nil
+}
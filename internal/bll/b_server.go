@@ -15,12 +15,13 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"crypto/x509"
 	"fmt"
 	"github.com/xtaci/smux"
 	"github.com/ztalab/ZASentinel/internal/config"
 	"github.com/ztalab/ZASentinel/internal/contextx"
 	"github.com/ztalab/ZASentinel/internal/event"
+	"github.com/ztalab/ZASentinel/internal/initer"
 	"github.com/ztalab/ZASentinel/internal/metrics"
 	"github.com/ztalab/ZASentinel/internal/schema"
 	"github.com/ztalab/ZASentinel/pkg/certificate"
@@ -28,85 +29,93 @@ import (
 	"github.com/ztalab/ZASentinel/pkg/logger"
 	"github.com/ztalab/ZASentinel/pkg/pconst"
 	"github.com/ztalab/ZASentinel/pkg/recover"
-	"github.com/ztalab/ZASentinel/pkg/util/json"
+	"github.com/ztalab/ZASentinel/pkg/util/trace"
+	"github.com/ztalab/ZASentinel/pkg/websocket"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
-	"strings"
 	"time"
 )
 
-type Server struct{}
+type Server struct {
+	limiter   *BandwidthLimiter
+	admission *AdmissionController
+	drainer   *Drainer
+	// handshakes Workers of the TLS handshakes, bound to the ctx of Listen
+	handshakes *HandshakePool
+}
 
-// ReadInitiaWSRequest Read the WS request
-func (a *Server) ReadInitiaWSRequest(ctx context.Context, connReader *bufio.Reader, conf *schema.ServerConfig) (*schema.ClientConfig, *http.Request, context.Context, error) {
-	expectedH1Req := "GET /secretLink"
-	firstBytes, err := connReader.Peek(len(expectedH1Req))
+// ReadInitiaWSRequest Read the WS request, limit caps the request line and headers
+func (a *Server) ReadInitiaWSRequest(ctx context.Context, connReader *bufio.Reader, limit *headerLimit, conf *schema.ServerConfig) (*schema.ClientConfig, *http.Request, context.Context, error) {
+	if err := checkPreamble(connReader); err != nil {
+		return nil, nil, ctx, err
+	}
+	req, err := readRequest(connReader, limit)
 	if err != nil {
-		return nil, nil, ctx, errors.WithStack(err)
+		return nil, nil, ctx, err
 	}
-	if string(firstBytes) == expectedH1Req {
-		req, err := http.ReadRequest(connReader)
-		if err != nil {
-			return nil, nil, ctx, errors.WithStack(err)
-		}
-		traceID := req.Header.Get("X-TraceID")
-		if traceID != "" {
-			ctx = contextx.NewTraceID(ctx, traceID)
-			ctx = logger.NewTraceIDContext(ctx, traceID)
-		}
-		if strings.ToLower(req.Header.Get("Connection")) != "upgrade" && strings.ToLower(req.Header.Get("Connection")) != "keep-alive, upgrade" {
-			return nil, nil, ctx, errors.WithStack(fmt.Errorf("Connection header expected: upgrade, got: %s\n",
-				strings.ToLower(req.Header.Get("Connection"))))
-		}
-		if strings.ToLower(req.Header.Get("Upgrade")) != "websocket" {
-			return nil, nil, ctx, errors.WithStack(fmt.Errorf("Upgrade header expected: websocket, got: %s\n",
-				strings.ToLower(req.Header.Get("Upgrade"))))
-		}
-		// Get link information
-		chainsJSON := strings.ToLower(req.Header.Get("X-Chains"))
-		if chainsJSON == "" {
-			return nil, nil, ctx, errors.NewWithStack("X-Chains argument is missing")
-		}
-		var chains schema.ClientConfig
-		err = json.Unmarshal([]byte(chainsJSON), &chains)
-		if err != nil {
-			return nil, nil, ctx, errors.WithStack(err)
-		}
-		// Verify the resources
-		if ok := conf.Resources.VerifyResources(chains.Target); !ok {
-			err := errors.New("The server verifies that the requested resource does not exist")
-			event.NewServerEvent(&chains, conf, event.TagResourceNotFound, err.Error()).Error(ctx)
-			return nil, nil, ctx, errors.WithStack(err)
-		}
-		// get client certificate
-		clientCa := req.Header.Get("X-ClientCert")
-		if clientCa == "" {
-			return nil, nil, ctx, errors.NewWithStack("X-ClientCert argument is missing")
+	traceID := req.Header.Get("X-TraceID")
+	if traceID != "" {
+		ctx = contextx.NewTraceID(ctx, traceID)
+		ctx = logger.NewTraceIDContext(ctx, traceID)
+	}
+	if err = websocket.CheckRequest(req); err != nil {
+		return nil, nil, ctx, handshakeError(metrics.RejectMalformed, http.StatusBadRequest, fmt.Errorf("%v, Connection: %s, Upgrade: %s",
+			err, req.Header.Get("Connection"), req.Header.Get("Upgrade")))
+	}
+	// Get link information, only used as the requested target
+	chains, err := readChains(req)
+	if err != nil {
+		return nil, nil, ctx, err
+	}
+	// Verify the previous relay certificate
+	if req.Header.Get("X-RelayCert") != "" {
+		if _, err = headerCert(req, "X-RelayCert"); err != nil {
+			event.NewServerEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+			return nil, nil, ctx, err
 		}
-		clientCaCert, err := base64.StdEncoding.DecodeString(clientCa)
+	}
+	// Verify the client certificate
+	clientCert, err := headerCert(req, "X-ClientCert")
+	if err != nil {
+		event.NewServerEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+		return nil, nil, ctx, err
+	}
+	// The permitted resources come from the verified certificate, not the client supplied header
+	grant, err := clientGrant(clientCert)
+	if err != nil {
+		event.NewServerEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+		return nil, nil, ctx, err
+	}
+	// The network is only known per stream, the target must be reachable over at least one.
+	// Without a session target, as with a SOCKS5 client, every stream names its own.
+	target := chains.Target
+	if target.Host != "" {
+		err = a.verifyTarget(schema.NetworkTCP, grant, conf, target)
 		if err != nil {
-			return nil, nil, ctx, errors.WithStack(err)
+			err = a.verifyTarget(schema.NetworkUDP, grant, conf, target)
 		}
-		// Verify the client certificate
-		err = certificate.NewVerify(string(clientCaCert), config.C.Certificate.CaPem, "").Verify()
 		if err != nil {
-			event.NewServerEvent(&chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
-			return nil, nil, ctx, errors.WithStack(err)
+			event.NewServerEvent(grant, conf, event.TagResourceNotFound, err.Error()).Error(ctx)
+			return nil, nil, ctx, err
 		}
-		return &chains, req, ctx, nil
 	}
-	req, err := http.ReadRequest(connReader)
-	if err != nil {
-		return nil, nil, ctx, errors.WithStack(err)
+	grant.Target = target
+	return grant, req, ctx, nil
+}
+
+// verifyTarget Verify that target is granted to the client and exposed by this server over network
+func (a *Server) verifyTarget(network string, grant *schema.ClientConfig, conf *schema.ServerConfig, target schema.Target) error {
+	targetAddr := target.Host + ":" + strconv.Itoa(target.Port)
+	if ok := grant.VerifyTarget(network, target); !ok {
+		return errors.WithStack(fmt.Errorf("The requested %s resource %s is not granted to client %s", network, targetAddr, grant.UUID))
 	}
-	reqBytes, err := httputil.DumpRequest(req, false)
-	if err != nil {
-		return nil, nil, ctx, errors.WithStack(err)
+	if ok := conf.Resources.VerifyNetworkResources(network, target); !ok {
+		return errors.WithStack(fmt.Errorf("The requested %s resource %s of client %s is not exposed by server %s", network, targetAddr, grant.UUID, conf.UUID))
 	}
-	err = errors.New("Server Illegal request:\n" + string(reqBytes))
-	return nil, nil, ctx, errors.WithStack(err)
+	return nil
 }
 
 // Responding to WS requests
@@ -127,9 +136,7 @@ func (a *Server) GenerateInitialWSResponse(ctx context.Context, clientConn net.C
 		Request:          nil,
 		TLS:              nil,
 	}
-	resp.Header.Set("Upgrade", req.Header.Get("Upgrade"))
-	resp.Header.Set("Connection", req.Header.Get("Connection"))
-	resp.Header.Set("X-ServerCert", base64.StdEncoding.EncodeToString([]byte(config.C.Certificate.CertPem)))
+	websocket.SetResponseHeaders(&resp, req)
 
 	res, err := httputil.DumpResponse(&resp, true)
 	_, err = clientConn.Write(res)
@@ -139,98 +146,362 @@ func (a *Server) GenerateInitialWSResponse(ctx context.Context, clientConn net.C
 	return res, err
 }
 
-func (a *Server) handleConn(ctx context.Context, conf *schema.ServerConfig, clientConn net.Conn) error {
-	begin := time.Now()
+// handshake Complete the TLS handshake of an accepted connection in a worker of the handshake pool,
+// the connection is then served in its own goroutine
+func (a *Server) handshake(ctx context.Context, conf *schema.ServerConfig, clientConn net.Conn) {
+	err := acceptProxyHeader(clientConn)
+	if err != nil {
+		_ = clientConn.Close()
+		metrics.AddRejectPoint(ctx, pconst.OperatorServer, metrics.RejectProxyHeader, clientConn.RemoteAddr().String(), conf.UUID, conf.Name)
+		logger.WithErrorStack(ctx, err).Error("PROXY protocol header error：", err)
+		return
+	}
+	releaseHandshake, err := a.admission.Handshake(clientConn.RemoteAddr())
+	if err != nil {
+		_ = clientConn.Close()
+		event.NewServerEvent(nil, conf, event.TagAdmissionReject, err.Error()).Warn(ctx)
+		return
+	}
+	peer, err := peerCertificate(clientConn)
+	releaseHandshake()
+	if err != nil {
+		_ = clientConn.Close()
+		metrics.AddRejectPoint(ctx, pconst.OperatorServer, metrics.RejectTLS, clientConn.RemoteAddr().String(), conf.UUID, conf.Name)
+		logger.WithErrorStack(ctx, err).Error("TLS handshake error：", err)
+		return
+	}
+	recover.Recovery(ctx, func() {
+		_ = a.handleConn(ctx, conf, clientConn, peer)
+	})
+}
+
+// handleConn Serve a connection of the previous hop, which authenticated with the peer certificate
+func (a *Server) handleConn(ctx context.Context, conf *schema.ServerConfig, clientConn net.Conn, peer *x509.Certificate) error {
+	// Health probes of the clients close right after the handshake
+	setPhaseDeadline(clientConn, requestTimeout())
 	connReader := bufio.NewReader(clientConn)
-	chains, req, ctx, err := a.ReadInitiaWSRequest(ctx, connReader, conf)
+	if _, err := connReader.Peek(1); err != nil {
+		if err != io.EOF {
+			rejectHandshake(ctx, pconst.OperatorServer, clientConn, err, metrics.RejectRequestTimeout, conf.UUID, conf.Name)
+		}
+		_ = clientConn.Close()
+		return nil
+	}
+	defer clientConn.Close()
+	return a.serveConn(ctx, conf, &bufferedConn{Conn: clientConn, r: connReader}, peer)
+}
+
+// serveConn Serve a tunnel from the previous hop, which authenticated with the peer certificate
+func (a *Server) serveConn(ctx context.Context, conf *schema.ServerConfig, clientConn net.Conn, peer *x509.Certificate) error {
+	begin := time.Now()
+	// The request must arrive in time and within the header limit
+	setPhaseDeadline(clientConn, requestTimeout())
+	limit := newHeaderLimit(clientConn)
+	connReader := bufio.NewReader(limit)
+	chains, req, ctx, err := a.ReadInitiaWSRequest(ctx, connReader, limit, conf)
 	if err != nil {
+		rejectHandshake(ctx, pconst.OperatorServer, clientConn, err, metrics.RejectRequestTimeout, conf.UUID, conf.Name)
 		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 		logger.WithErrorStack(ctx, err).Error("Error obtaining WS request information：", err)
 		return err
 	}
+	// The previous hop must own the certificate it announced
+	client, err := verifyHopCert(peer, req)
+	if err != nil {
+		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+		event.NewServerEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+		logger.WithErrorStack(ctx, err).Error("Previous hop certificate error：", err)
+		return err
+	}
+	// The limits apply to the verified client, not to the relay it came through. Tunnels opened over a
+	// reverse-connect registration are admitted here as well.
+	release, err := a.admission.Admit(peerIdentity(client))
+	if err != nil {
+		rejectConn(clientConn, err.(*AdmissionError))
+		event.NewServerEvent(chains, conf, event.TagAdmissionReject, err.Error()).Warn(ctx)
+		return err
+	}
+	defer release()
+	setPhaseDeadline(clientConn, writeTimeout())
 	_, err = a.GenerateInitialWSResponse(ctx, clientConn, req)
 	if err != nil {
+		rejectHandshake(ctx, pconst.OperatorServer, clientConn, err, metrics.RejectWriteTimeout, conf.UUID, conf.Name)
 		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 		logger.WithErrorStack(ctx, err).Error("Response WS message error：", err)
 		return err
 	}
 	verifyFlag := "serverCaReady"
-	verifyBytes, err := connReader.Peek(len(verifyFlag))
+	wsConn := websocket.NewConn(clientConn, connReader, false)
+	verifyBytes := make([]byte, len(verifyFlag))
+	// The deadline also covers the end-to-end TLS handshake
+	setPhaseDeadline(clientConn, readyTimeout())
+	_, err = io.ReadFull(wsConn, verifyBytes)
 	if err != nil {
+		rejectHandshake(ctx, pconst.OperatorServer, clientConn, err, metrics.RejectReadyTimeout, conf.UUID, conf.Name)
 		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 		logger.WithErrorStack(ctx, err).Error("Error obtaining the certificate verification result.：", err)
 		return err
 	}
 	if string(verifyBytes) == verifyFlag {
-		targetAddr := chains.Target.Host + ":" + strconv.Itoa(chains.Target.Port)
-		serverConn, err := net.Dial("tcp", targetAddr)
-		if err != nil {
+		defer func() {
+			closeErr := wsConn.Close()
+			if closeErr != nil {
+				logger.WithContext(ctx).Errorf("Closed Connection with error: %v\n", closeErr)
+			} else {
+				logger.WithContext(ctx).Infof("Closed Connection: %v\n", clientConn.RemoteAddr().String())
+			}
+		}()
+		// The client proves possession of the key of X-ClientCert through all relays, then starts the
+		// end-to-end TLS session pinned to the same certificate
+		clientCert, _ := headerPem(req, "X-ClientCert")
+		if err = challengeClient(wsConn, clientCert); err != nil {
+			rejectHandshake(ctx, pconst.OperatorServer, clientConn, err, metrics.RejectReadyTimeout, conf.UUID, conf.Name)
 			metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
-			event.NewServerEvent(chains, conf, event.TagConnectFail, err.Error()).Error(ctx)
-			logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to request resource from server\n:Addr:%s Error:%v", targetAddr, err)
+			event.NewServerEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+			logger.WithErrorStack(ctx, err).Error("Client challenge failed：", err)
 			return err
 		}
-		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqSuccess, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
-		event.NewServerEvent(chains, conf, event.TagConnectSuccess, "").Info(ctx)
-		// 多路复用
-		session, err := smux.Server(clientConn, nil)
+		innerConn, err := innerServer(wsConn, clientCert)
 		if err != nil {
+			rejectHandshake(ctx, pconst.OperatorServer, clientConn, err, metrics.RejectReadyTimeout, conf.UUID, conf.Name)
+			metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+			event.NewServerEvent(chains, conf, event.TagClientTLSFail, err.Error()).Error(ctx)
+			logger.WithErrorStack(ctx, err).Error("End-to-end TLS handshake failed：", err)
 			return err
 		}
-		stream, err := session.AcceptStream()
+		setPhaseDeadline(clientConn, 0)
+		// Identity of the user, passed on to the resources taking PROXY protocol v2 headers
+		identity := ""
+		if cert, err := certificate.ParseCertificate(clientCert); err == nil {
+			identity = cert.Subject.CommonName
+		}
+		// 多路复用
+		session, err := smux.Server(innerConn, smuxConfig())
 		if err != nil {
 			return err
 		}
-		defer func() {
-			closeErr := clientConn.Close()
-			if closeErr != nil {
-				logger.WithContext(ctx).Errorf("Closed Connection with error: %v\n", closeErr)
-			} else {
-				logger.WithContext(ctx).Infof("Closed Connection: %v\n", clientConn.RemoteAddr().String())
+		defer session.Close()
+		// On shutdown the client opens its next streams on a new tunnel and the tunnel is closed once its
+		// streams ended
+		defer goAwayOnDone(ctx, wsConn)()
+		defer closeWhenIdle(ctx, session)()
+		// Every stream of the session is one proxied connection
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.WithContext(ctx).Infof("Tunnel of %s ended: %s", clientConn.RemoteAddr().String(), sessionEndReason(err))
+				}
+				if session.IsClosed() {
+					return nil
+				}
+				return err
 			}
-			serverConn.Close()
-			session.Close()
-			stream.Close()
-		}()
-		TransparentProxy(stream, serverConn)
-		return nil
+			recover.Recovery(ctx, func() {
+				a.handleStream(ctx, conf, chains, identity, stream)
+			})
+		}
 	}
 	err = errors.New("Server certificate verification failed")
 	logger.WithErrorStack(ctx, errors.WithStack(err)).Error(err)
+	metrics.AddRejectPoint(ctx, pconst.OperatorServer, metrics.RejectMalformed, clientConn.RemoteAddr().String(), conf.UUID, conf.Name)
 	metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
 	return err
 }
 
+// handleStream Connect one stream to the target resource, identity is the common name of the client certificate
+func (a *Server) handleStream(ctx context.Context, conf *schema.ServerConfig, chains *schema.ClientConfig, identity string, stream *smux.Stream) {
+	begin := time.Now()
+	defer stream.Close()
+	header, err := readStreamHeader(stream)
+	if err != nil {
+		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+		logger.WithErrorStack(ctx, err).Error("Error reading the stream header：", err)
+		return
+	}
+	if header.Network == schema.NetworkTCP {
+		// UDP flows only end when idle, they are not waited for on shutdown
+		defer a.drainer.Begin()()
+	}
+	target := chains.Target
+	if header.Target != nil {
+		target = *header.Target
+	}
+	if target.Host == "" {
+		err = errors.NewWithStack("The stream has no target")
+	} else {
+		err = a.verifyTarget(header.Network, chains, conf, target)
+	}
+	if err != nil {
+		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+		event.NewServerEvent(chains, conf, event.TagResourceNotFound, err.Error()).Error(ctx)
+		logger.WithErrorStack(ctx, err).Error("Stream target rejected：", err)
+		return
+	}
+	targetAddr := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	serverConn, err := dialer().Dial(header.Network, targetAddr)
+	if err != nil {
+		metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+		event.NewServerEvent(chains, conf, event.TagConnectFail, err.Error()).Error(ctx)
+		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to request resource from server\n:Addr:%s Error:%v", targetAddr, err)
+		return
+	}
+	defer serverConn.Close()
+	resource := conf.Resources.MatchResource(header.Network, target)
+	if resource != nil && resource.ProxyProtocol != "" && header.Network == schema.NetworkTCP {
+		// The resource sees the original client instead of this server
+		err = writeProxyHeader(serverConn, resource.ProxyProtocol, parseTCPAddr(header.Source), serverConn.RemoteAddr(), []proxyTLV{
+			{typ: schema.ProxyTLVClientUUID, value: chains.UUID},
+			{typ: schema.ProxyTLVIdentity, value: identity},
+		})
+		if err != nil {
+			metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqFail, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+			event.NewServerEvent(chains, conf, event.TagConnectFail, err.Error()).Error(ctx)
+			logger.WithErrorStack(ctx, err).Errorf("Failed to send the PROXY protocol header to %s: %v", targetAddr, err)
+			return
+		}
+	}
+	metrics.AddDelayPoint(ctx, pconst.OperatorServer, metrics.ReqSuccess, time.Now().Sub(begin).String(), conf.UUID, conf.Name)
+	event.NewServerEvent(chains, conf, event.TagConnectSuccess, "").Info(ctx)
+	var tunnel net.Conn = stream
+	if header.HalfClose {
+		tunnel = &framedStream{Conn: stream}
+	}
+	clientSide, serverSide, releaseLimits := a.limiter.Limit(ctx, conf.UUID, conf.Name, chains.UUID, resource, tunnel, serverConn)
+	defer releaseLimits()
+	var result *ProxyResult
+	if header.Network == schema.NetworkUDP {
+		// The connected socket is the association of this flow, it lives as long as the stream
+		result = UDPProxy(clientSide, serverSide)
+	} else {
+		result = TransparentProxy(clientSide, serverSide)
+	}
+	resourceID := ""
+	if resource != nil {
+		resourceID = resource.UUID
+	}
+	recordSession(ctx, event.NewServerEvent(chains, conf, event.TagDisconnect, ""), chains.UUID, targetAddr, resourceID, result, conf.UUID, conf.Name)
+}
+
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		limiter:   NewBandwidthLimiter(pconst.OperatorServer),
+		admission: NewAdmissionController(),
+		drainer:   NewDrainer(),
+	}
 }
 
-func (a *Server) Listen(ctx context.Context, attrs map[string]interface{}) {
-	go func() {
-		conf, err := schema.ParseServerConfig(attrs)
-		if err != nil {
-			panic(err)
-		}
-		cert, err := tls.X509KeyPair([]byte(config.C.Certificate.CertPem), []byte(config.C.Certificate.KeyPem))
-		if err != nil {
-			panic(err)
+// Drain Wait for the proxied connections in flight once Listen stopped accepting
+func (a *Server) Drain(ctx context.Context) {
+	a.drainer.Drain(ctx, drainTimeout())
+}
+
+// Listen Serve the previous hops until ctx is done, idle tunnels are closed then. Returns once the
+// listeners are open, or the registrations with the relays started in reverse-connect mode.
+func (a *Server) Listen(ctx context.Context, attrs map[string]interface{}) error {
+	conf, err := schema.ParseServerConfig(attrs)
+	if err != nil {
+		return err
+	}
+	if config.C.Reverse.Enabled {
+		// Reverse-connect mode, no inbound port is opened
+		for _, relayAddr := range config.C.Reverse.Relays {
+			go a.Register(ctx, conf, relayAddr)
 		}
-		l, err := tls.Listen("tcp", "0.0.0.0:"+strconv.Itoa(conf.Port), &tls.Config{
-			Certificates: []tls.Certificate{cert},
+		return nil
+	}
+	a.handshakes = NewHandshakePool(ctx)
+	return listenPeers(ctx, "Server", conf.Port, func(conn net.Conn) {
+		a.handshakes.Dispatch(conn, func(conn net.Conn) {
+			a.handshake(ctx, conf, conn)
 		})
+	})
+}
+
+// Register Keep a registration with the relay at relayAddr in reverse-connect mode, registering again when it ends
+func (a *Server) Register(ctx context.Context, conf *schema.ServerConfig, relayAddr string) {
+	interval := time.Duration(config.C.Reverse.RetryInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	for {
+		err := a.register(ctx, conf, relayAddr)
+		if ctx.Err() != nil {
+			logger.WithContext(ctx).Infof("Stopped registering with relay %s", relayAddr)
+			return
+		}
 		if err != nil {
-			panic(err)
+			logger.WithErrorStack(ctx, err).Errorf("Failed to register with relay %s: %v", relayAddr, err)
 		}
-		logger.WithContext(ctx).Printf("Started ZERO ACCESS Server at %v\n", l.Addr().String())
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				logger.WithContext(ctx).Error("Failed to accept connection:", err)
-				continue
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
+
+// register Register with the relay and serve the client streams it opens until the registration ends
+func (a *Server) register(ctx context.Context, conf *schema.ServerConfig, relayAddr string) error {
+	tlsConfig, err := DialTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig.VerifyPeerCertificate = VerifyPeerType(initer.TypeRelay)
+	conn, err := tls.DialWithDialer(dialer(), "tcp", relayAddr, tlsConfig)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	relayCert := conn.ConnectionState().PeerCertificates[0]
+
+	req, err := http.NewRequest("GET", registerPath, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Host, _, _ = net.SplitHostPort(relayAddr)
+	wsKey, err := websocket.SetRequestHeaders(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	traceID := trace.NewTraceID()
+	ctx = contextx.NewTraceID(ctx, traceID)
+	ctx = logger.NewTraceIDContext(ctx, traceID)
+	req.Header.Set("X-TraceID", traceID)
+	// The TLS handshake was bound by the dial timeout, the registration has its own deadline
+	setPhaseDeadline(conn, requestTimeout())
+	if err = req.Write(conn); err != nil {
+		return errors.WithStack(err)
+	}
+	connReader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(connReader, req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = websocket.CheckResponse(resp, wsKey); err != nil {
+		return errors.WithStack(err)
+	}
+	// The session keepalive takes over
+	setPhaseDeadline(conn, 0)
+	session, err := smux.Server(websocket.NewConn(conn, connReader, true), smuxConfig())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer session.Close()
+	// On shutdown the registration ends once its tunnels ended
+	defer closeWhenIdle(ctx, session)()
+	logger.WithContext(ctx).Infof("Registered with relay %s", relayAddr)
+	// Every stream is a tunnel from the relay, served like an inbound connection
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.WithContext(ctx).Warnf("Registration with relay %s ended: %s", relayAddr, sessionEndReason(err))
 			}
-			recover.Recovery(ctx, func() {
-				a.handleConn(ctx, conf, conn)
-			})
+			return nil
 		}
-	}()
+		recover.Recovery(ctx, func() {
+			defer stream.Close()
+			_ = a.serveConn(ctx, conf, stream, relayCert)
+		})
+	}
 }
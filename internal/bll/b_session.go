@@ -0,0 +1,338 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/xtaci/smux"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/util/json"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxStreamHeader Largest stream header accepted
+const maxStreamHeader = 4096
+
+// DialFunc Establish the underlying tunnel connection of a session, goAway is called once the next hop
+// asks to open the next streams on a new session
+type DialFunc func(goAway func()) (net.Conn, error)
+
+// SessionEndFunc Called when a session of key ended other than by closing the pool, err is what AcceptStream returned
+type SessionEndFunc func(key string, err error)
+
+// SessionPool Multiplexed sessions shared by all connections to the same next hop
+type SessionPool struct {
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+	closed  int32
+	ended   SessionEndFunc
+}
+
+type poolEntry struct {
+	mu      sync.Mutex
+	session *pooledSession
+	// dialing The dial of the next session in flight, nil when there is none
+	dialing *poolDial
+}
+
+// poolDial A dial shared by the connections waiting for a session, done is closed once session or err is set
+type poolDial struct {
+	done    chan struct{}
+	session *pooledSession
+	err     error
+}
+
+// pooledSession A session of the pool, once the next hop asked it to go away no stream is opened on it
+// and it is closed once its streams ended
+type pooledSession struct {
+	*smux.Session
+	away     chan struct{}
+	awayOnce sync.Once
+}
+
+func newPooledSession() *pooledSession {
+	return &pooledSession{away: make(chan struct{})}
+}
+
+func (a *pooledSession) goAway() {
+	a.awayOnce.Do(func() {
+		close(a.away)
+	})
+}
+
+func (a *pooledSession) goneAway() bool {
+	select {
+	case <-a.away:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeWhenGone Close the session once it went away and its streams ended, until done
+func (a *pooledSession) closeWhenGone(done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-a.away:
+	}
+	poll := time.NewTicker(drainPollInterval)
+	defer poll.Stop()
+	for a.NumStreams() > 0 {
+		select {
+		case <-done:
+			return
+		case <-poll.C:
+		}
+	}
+	_ = a.Close()
+}
+
+// NewSessionPool ended may be nil
+func NewSessionPool(ended SessionEndFunc) *SessionPool {
+	return &SessionPool{
+		entries: make(map[string]*poolEntry),
+		ended:   ended,
+	}
+}
+
+// OpenStream Open a stream on the live session of key, dialing a new session when there is none, the
+// current one is dead or it went away. One dial is in flight per key, the connections arriving meanwhile
+// wait for it until ctx is done.
+func (a *SessionPool) OpenStream(ctx context.Context, key string, dial DialFunc) (*smux.Stream, error) {
+	entry := a.entry(key)
+	for {
+		entry.mu.Lock()
+		session := entry.session
+		if session != nil && !session.IsClosed() && !session.goneAway() {
+			entry.mu.Unlock()
+			stream, err := session.OpenStream()
+			if err == nil {
+				return stream, nil
+			}
+			// Dead, dropped unless a new session replaced it meanwhile
+			entry.mu.Lock()
+			if entry.session == session {
+				_ = session.Close()
+				entry.session = nil
+			}
+			entry.mu.Unlock()
+			continue
+		}
+		if session != nil {
+			// A session that went away is left to its streams, a dead one is dropped, both are replaced
+			if !session.goneAway() {
+				_ = session.Close()
+			}
+			entry.session = nil
+		}
+		pending := entry.dialing
+		if pending == nil {
+			pending = &poolDial{done: make(chan struct{})}
+			entry.dialing = pending
+			go a.dial(key, entry, pending, dial)
+		}
+		entry.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		case <-pending.done:
+		}
+		if pending.err != nil {
+			return nil, pending.err
+		}
+		stream, err := pending.session.OpenStream()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return stream, nil
+	}
+}
+
+// dial Dial the next session of key outside the lock of the entry, so that a stalled next hop only holds up
+// the connections waiting for it
+func (a *SessionPool) dial(key string, entry *poolEntry, pending *poolDial, dial DialFunc) {
+	pooled := newPooledSession()
+	session, err := func() (*smux.Session, error) {
+		conn, err := dial(pooled.goAway)
+		if err != nil {
+			return nil, err
+		}
+		session, err := smux.Client(conn, smuxConfig())
+		if err != nil {
+			_ = conn.Close()
+			return nil, errors.WithStack(err)
+		}
+		return session, nil
+	}()
+	entry.mu.Lock()
+	entry.dialing = nil
+	if err == nil {
+		pooled.Session = session
+		entry.session = pooled
+		if atomic.LoadInt32(&a.closed) == 1 {
+			_ = session.Close()
+		}
+		go a.watch(key, pooled)
+	}
+	entry.mu.Unlock()
+	pending.session, pending.err = pooled, err
+	close(pending.done)
+}
+
+// watch Wait for the session to end, the next hop never opens streams so that AcceptStream only
+// returns then. The session is dropped by the next OpenStream, one that went away ends unreported.
+func (a *SessionPool) watch(key string, session *pooledSession) {
+	done := make(chan struct{})
+	defer close(done)
+	go session.closeWhenGone(done)
+	_, err := session.AcceptStream()
+	if err == nil {
+		_ = session.Close()
+		err = errors.NewWithStack("the next hop opened a stream")
+	}
+	if a.ended != nil && atomic.LoadInt32(&a.closed) == 0 && !session.goneAway() {
+		a.ended(key, err)
+	}
+}
+
+// Close Close all sessions
+func (a *SessionPool) Close() {
+	atomic.StoreInt32(&a.closed, 1)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, entry := range a.entries {
+		entry.mu.Lock()
+		if entry.session != nil {
+			_ = entry.session.Close()
+		}
+		entry.mu.Unlock()
+		delete(a.entries, key)
+	}
+}
+
+func (a *SessionPool) entry(key string) *poolEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.entries[key]
+	if !ok {
+		entry = new(poolEntry)
+		a.entries[key] = entry
+	}
+	return entry
+}
+
+// writeStreamHeader Send the header of a newly opened stream, a 2 byte length followed by JSON
+func writeStreamHeader(w io.Writer, header *schema.StreamHeader) error {
+	body, err := json.Marshal(header)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf := make([]byte, 2, 2+len(body))
+	binary.BigEndian.PutUint16(buf, uint16(len(body)))
+	buf = append(buf, body...)
+	if _, err = w.Write(buf); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// readStreamHeader Read the header of an accepted stream, the network defaults to tcp
+func readStreamHeader(r io.Reader) (*schema.StreamHeader, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	length := int(binary.BigEndian.Uint16(size[:]))
+	if length > maxStreamHeader {
+		return nil, errors.NewWithStack("Stream header too large")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	header := new(schema.StreamHeader)
+	if err := json.Unmarshal(body, header); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch header.Network {
+	case "":
+		header.Network = schema.NetworkTCP
+	case schema.NetworkTCP, schema.NetworkUDP:
+	default:
+		return nil, errors.NewWithStack("Unsupported stream network: " + header.Network)
+	}
+	return header, nil
+}
+
+// framedStream A tunnel stream carrying TCP in frames of a 2 byte length and the payload. An empty
+// frame ends the direction, so that half-close crosses smux whose streams cannot half-close.
+type framedStream struct {
+	net.Conn
+	remaining int
+	readEOF   bool
+}
+
+func (c *framedStream) Read(p []byte) (int, error) {
+	if c.readEOF {
+		return 0, io.EOF
+	}
+	for c.remaining == 0 {
+		var size [2]byte
+		if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+			return 0, err
+		}
+		c.remaining = int(binary.BigEndian.Uint16(size[:]))
+		if c.remaining == 0 {
+			c.readEOF = true
+			return 0, io.EOF
+		}
+	}
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.Conn.Read(p)
+	c.remaining -= n
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *framedStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		frame := p
+		if len(frame) > maxDatagram {
+			frame = frame[:maxDatagram]
+		}
+		if err := writeDatagram(c.Conn, frame); err != nil {
+			return written, err
+		}
+		written += len(frame)
+		p = p[len(frame):]
+	}
+	return written, nil
+}
+
+// CloseWrite Send the empty frame ending this direction
+func (c *framedStream) CloseWrite() error {
+	_, err := c.Conn.Write([]byte{0, 0})
+	return err
+}
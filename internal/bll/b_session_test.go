@@ -0,0 +1,342 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bytes"
+	"context"
+	"github.com/xtaci/smux"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bufConn A connection reading from r and writing into w
+type bufConn struct {
+	net.Conn
+	r      io.Reader
+	w      bytes.Buffer
+	closed bool
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		return 0, io.EOF
+	}
+	return c.r.Read(p)
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return c.w.Write(p)
+}
+
+func (c *bufConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestStreamHeaderRoundTrip(t *testing.T) {
+	headers := []*schema.StreamHeader{
+		{Network: schema.NetworkTCP, HalfClose: true, Source: "10.0.0.1:4000"},
+		{Network: schema.NetworkUDP, Target: &schema.Target{Host: "db.corp.com", Port: 53}},
+		{},
+	}
+	for _, header := range headers {
+		var buf bytes.Buffer
+		if err := writeStreamHeader(&buf, header); err != nil {
+			t.Fatal(err)
+		}
+		buf.WriteString("payload")
+		got, err := readStreamHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := *header
+		if want.Network == "" {
+			want.Network = schema.NetworkTCP
+		}
+		if got.Network != want.Network || got.HalfClose != want.HalfClose || got.Source != want.Source ||
+			(got.Target == nil) != (want.Target == nil) || (got.Target != nil && *got.Target != *want.Target) {
+			t.Errorf("read %+v, want %+v", got, want)
+		}
+		if buf.String() != "payload" {
+			t.Errorf("the payload after the header became %q", buf.String())
+		}
+	}
+}
+
+func TestReadStreamHeaderMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"truncated length", []byte{0}},
+		{"truncated body", []byte{0, 10, '{'}},
+		{"too large", append([]byte{0x10, 0x01}, make([]byte, maxStreamHeader+1)...)},
+		{"not json", append([]byte{0, 3}, "abc"...)},
+		{"network", append([]byte{0, 18}, `{"network":"icmp"}`...)},
+	}
+	for _, tt := range tests {
+		if header, err := readStreamHeader(bytes.NewReader(tt.input)); err == nil {
+			t.Errorf("%s: read %+v", tt.name, header)
+		}
+	}
+}
+
+func TestFramedStreamHalfClose(t *testing.T) {
+	left, right := net.Pipe()
+	defer left.Close()
+	defer right.Close()
+	a, b := &framedStream{Conn: left}, &framedStream{Conn: right}
+	// Larger than a frame
+	msg := bytes.Repeat([]byte("0123456789"), 15000)
+	errs := make(chan error, 1)
+	go func() {
+		if _, err := a.Write(msg); err != nil {
+			errs <- err
+			return
+		}
+		errs <- a.CloseWrite()
+	}()
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(msg))
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read after the end = %d, %v", n, err)
+	}
+
+	// The other direction still flows
+	go func() {
+		if _, err := b.Write([]byte("reply")); err != nil {
+			errs <- err
+			return
+		}
+		errs <- b.CloseWrite()
+	}()
+	got, err = io.ReadAll(a)
+	if err != nil || string(got) != "reply" {
+		t.Fatalf("reply %q, %v", got, err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFramedStreamTruncated(t *testing.T) {
+	stream := &framedStream{Conn: &bufConn{r: strings.NewReader("\x00\x05ab")}}
+	got, err := io.ReadAll(stream)
+	if string(got) != "ab" || err != io.ErrUnexpectedEOF {
+		t.Errorf("read %q, %v", got, err)
+	}
+	stream = &framedStream{Conn: &bufConn{r: strings.NewReader("\x00")}}
+	if _, err = stream.Read(make([]byte, 1)); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated length read %v", err)
+	}
+}
+
+// pipeDialer Dial sessions to an in-memory next hop, keeping what each dial got
+type pipeDialer struct {
+	t       *testing.T
+	mu      sync.Mutex
+	goAways []func()
+	servers []*smux.Session
+}
+
+func (d *pipeDialer) dial(goAway func()) (net.Conn, error) {
+	local, remote := net.Pipe()
+	server, err := smux.Server(remote, smuxConfig())
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := server.AcceptStream(); err != nil {
+				_ = server.Close()
+				return
+			}
+		}
+	}()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.goAways = append(d.goAways, goAway)
+	d.servers = append(d.servers, server)
+	return local, nil
+}
+
+func TestSessionPoolReuse(t *testing.T) {
+	pool := NewSessionPool(nil)
+	defer pool.Close()
+	d := &pipeDialer{t: t}
+	for i := 0; i < 3; i++ {
+		stream, err := pool.OpenStream(context.Background(), "hop", d.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = stream.Close()
+	}
+	if len(d.servers) != 1 {
+		t.Errorf("%d sessions dialed, want 1", len(d.servers))
+	}
+}
+
+func TestSessionPoolGoAway(t *testing.T) {
+	var ended int32
+	pool := NewSessionPool(func(key string, err error) {
+		atomic.AddInt32(&ended, 1)
+	})
+	defer pool.Close()
+	d := &pipeDialer{t: t}
+	inFlight, err := pool.OpenStream(context.Background(), "hop", d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.goAways[0]()
+	stream, err := pool.OpenStream(context.Background(), "hop", d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.servers) != 2 {
+		t.Fatal("the stream after the go away did not dial a new session")
+	}
+	_ = stream.Close()
+
+	// The session that went away stays until its stream ended
+	time.Sleep(3 * drainPollInterval)
+	if d.servers[0].IsClosed() {
+		t.Fatal("the session that went away was closed with a stream in flight")
+	}
+	if _, err = inFlight.Write([]byte("still")); err != nil {
+		t.Fatal(err)
+	}
+	_ = inFlight.Close()
+	deadline := time.Now().Add(time.Second)
+	for !d.servers[0].IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the session that went away was not closed once its streams ended")
+		}
+		time.Sleep(drainPollInterval)
+	}
+	if d.servers[1].IsClosed() {
+		t.Error("the new session was closed")
+	}
+	if atomic.LoadInt32(&ended) != 0 {
+		t.Error("the session that went away was reported ended")
+	}
+}
+
+func TestSessionPoolSharesDial(t *testing.T) {
+	pool := NewSessionPool(nil)
+	defer pool.Close()
+	d := &pipeDialer{t: t}
+	release := make(chan struct{})
+	var dials int32
+	dial := func(goAway func()) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		return d.dial(goAway)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := pool.OpenStream(context.Background(), "hop", dial)
+			if err == nil {
+				_ = stream.Close()
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("%d dials for concurrent streams, want 1", n)
+	}
+}
+
+func TestSessionPoolStalledDial(t *testing.T) {
+	pool := NewSessionPool(nil)
+	defer pool.Close()
+	stalled := make(chan struct{})
+	defer close(stalled)
+	stall := func(goAway func()) (net.Conn, error) {
+		<-stalled
+		return nil, errors.New("stalled")
+	}
+	// Waiting for a stalled next hop ends with the context of the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.OpenStream(ctx, "stalled", stall); err == nil || ctx.Err() == nil {
+		t.Fatalf("waiting for a stalled dial returned %v", err)
+	}
+	// Other next hops are not held up
+	d := &pipeDialer{t: t}
+	done := make(chan error, 1)
+	go func() {
+		stream, err := pool.OpenStream(context.Background(), "other", d.dial)
+		if err == nil {
+			_ = stream.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a stalled next hop held up another one")
+	}
+}
+
+func TestSessionPoolDialFailure(t *testing.T) {
+	pool := NewSessionPool(nil)
+	defer pool.Close()
+	fail := func(goAway func()) (net.Conn, error) {
+		return nil, errors.New("refused")
+	}
+	if _, err := pool.OpenStream(context.Background(), "hop", fail); err == nil || err.Error() != "refused" {
+		t.Fatalf("a failed dial returned %v", err)
+	}
+	// The next connection dials again
+	d := &pipeDialer{t: t}
+	stream, err := pool.OpenStream(context.Background(), "hop", d.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.Close()
+}
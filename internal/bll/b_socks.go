@@ -0,0 +1,363 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"github.com/ztalab/ZASentinel/pkg/recover"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5, RFC 1928
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded        = 0x00
+	socksRepGeneralFailure   = 0x01
+	socksRepNotAllowed       = 0x02
+	socksRepCmdNotSupported  = 0x07
+	socksRepAtypNotSupported = 0x08
+
+	// socksUDPHeaderLen RSV(2) FRAG(1) ahead of the address of a UDP request
+	socksUDPHeaderLen = 3
+)
+
+// socksHandshakeTimeout Time allowed for the negotiation and the request
+const socksHandshakeTimeout = 10 * time.Second
+
+// bufferedConn A connection whose first bytes were already buffered by a reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// handleSocks Serve one SOCKS5 connection, tunneling to the requested destination when it is granted
+func (a *Client) handleSocks(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn) {
+	ctx = newTraceContext(ctx)
+	defer closeClientConn(ctx, clientConn)
+
+	_ = clientConn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(clientConn)
+	if err := socksNegotiate(br, clientConn); err != nil {
+		logger.WithErrorStack(ctx, err).Errorf("SOCKS5 negotiation failed: %v", err)
+		return
+	}
+	cmd, target, rep, err := socksReadRequest(br)
+	if err != nil {
+		_ = socksWriteReply(clientConn, rep, nil)
+		logger.WithErrorStack(ctx, err).Errorf("SOCKS5 request error: %v", err)
+		return
+	}
+	_ = clientConn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socksCmdConnect:
+		a.socksConnect(ctx, conf, &bufferedConn{Conn: clientConn, r: br}, target)
+	case socksCmdUDPAssociate:
+		a.socksUDPAssociate(ctx, conf, clientConn)
+	default:
+		_ = socksWriteReply(clientConn, socksRepCmdNotSupported, nil)
+	}
+}
+
+// socksConnect Tunnel a CONNECT request
+func (a *Client) socksConnect(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn, target schema.Target) {
+	target, err := a.verifyTarget(ctx, conf, schema.NetworkTCP, target)
+	if err != nil {
+		_ = socksWriteReply(clientConn, socksRepNotAllowed, nil)
+		return
+	}
+	stream, err := a.openStream(ctx, conf, &schema.StreamHeader{Network: schema.NetworkTCP, Target: &target, Source: clientConn.RemoteAddr().String()})
+	if err != nil {
+		_ = socksWriteReply(clientConn, socksRepGeneralFailure, nil)
+		logger.WithErrorStack(ctx, err).Errorf("The client failed to request the lower level service. Procedure:Error:%v", err)
+		return
+	}
+	defer stream.Close()
+	if err = socksWriteReply(clientConn, socksRepSucceeded, clientConn.LocalAddr()); err != nil {
+		return
+	}
+	a.recordSession(ctx, conf, targetAddr(target), TransparentProxy(clientConn, stream))
+}
+
+// socksUDPAssociate Relay the datagrams of a UDP ASSOCIATE request, one stream per destination,
+// for as long as the control connection stays open
+func (a *Client) socksUDPAssociate(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn) {
+	host, _, err := net.SplitHostPort(clientConn.LocalAddr().String())
+	if err != nil {
+		_ = socksWriteReply(clientConn, socksRepGeneralFailure, nil)
+		return
+	}
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = socksWriteReply(clientConn, socksRepGeneralFailure, nil)
+		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("SOCKS5 UDP listen failed: %v", err)
+		return
+	}
+	defer pc.Close()
+	if err = socksWriteReply(clientConn, socksRepSucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+
+	flows := newUDPFlows()
+	defer flows.close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// The association ends with the control connection
+		_, _ = io.Copy(ioutil.Discard, clientConn)
+		_ = pc.Close()
+	}()
+	go func() {
+		timeout := udpIdleTimeout()
+		ticker := time.NewTicker(expireInterval(timeout))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				flows.expire(timeout)
+			}
+		}
+	}()
+
+	clientIP := clientConn.RemoteAddr().(*net.TCPAddr).IP
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// Only the client of the control connection may use the association
+		if udpAddr, ok := addr.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(clientIP) {
+			continue
+		}
+		// Fragmented datagrams are not supported
+		if n < socksUDPHeaderLen || buf[2] != 0 {
+			continue
+		}
+		target, size, err := socksParseAddr(buf[socksUDPHeaderLen:n])
+		if err != nil {
+			continue
+		}
+		payload := buf[socksUDPHeaderLen+size : n]
+		key := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+		flow := flows.get(key)
+		if flow == nil {
+			streamTarget, err := a.verifyTarget(ctx, conf, schema.NetworkUDP, target)
+			if err != nil {
+				continue
+			}
+			flowCtx := newTraceContext(ctx)
+			stream, err := a.openStream(flowCtx, conf, &schema.StreamHeader{Network: schema.NetworkUDP, Target: &streamTarget, Source: addr.String()})
+			if err != nil {
+				logger.WithErrorStack(flowCtx, err).Errorf("Failed to open UDP flow for %s: %v", key, err)
+				continue
+			}
+			flow = newUDPFlow(stream)
+			flows.add(key, flow)
+			header := socksAppendAddr([]byte{0, 0, 0}, target)
+			recover.Recovery(flowCtx, func() {
+				a.handleSocksUDPFlow(flowCtx, conf, pc, addr, header, key, flows, flow)
+			})
+		}
+		if err = writeDatagram(flow.stream, payload); err != nil {
+			flow.end(CloseReasonServerError)
+			flow.close()
+			flows.remove(key, flow)
+			continue
+		}
+		flow.sent(len(payload))
+	}
+}
+
+// handleSocksUDPFlow Send the datagrams of the stream back to the client behind the SOCKS5 UDP header
+func (a *Client) handleSocksUDPFlow(ctx context.Context, conf *schema.ClientConfig, pc net.PacketConn, addr net.Addr, header []byte, key string, flows *udpFlows, flow *udpFlow) {
+	defer func() {
+		flow.close()
+		flows.remove(key, flow)
+		a.recordSession(ctx, conf, key, flow.result())
+	}()
+	buf := make([]byte, len(header)+maxDatagram)
+	copy(buf, header)
+	for {
+		n, err := readDatagram(flow.stream, buf[len(header):])
+		if err != nil {
+			flow.end(CloseReasonServerClosed)
+			return
+		}
+		if _, err = pc.WriteTo(buf[:len(header)+n], addr); err != nil {
+			flow.end(CloseReasonClientError)
+			return
+		}
+		flow.received(n)
+	}
+}
+
+// socksNegotiate Select the no authentication method, the only one supported
+func socksNegotiate(r *bufio.Reader, w io.Writer) error {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if head[0] != socksVersion {
+		return errors.NewWithStack("Unsupported SOCKS version: " + strconv.Itoa(int(head[0])))
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, method := range methods {
+		if method == socksMethodNoAuth {
+			_, err := w.Write([]byte{socksVersion, socksMethodNoAuth})
+			return errors.WithStack(err)
+		}
+	}
+	_, _ = w.Write([]byte{socksVersion, socksMethodNoAcceptable})
+	return errors.NewWithStack("No acceptable SOCKS authentication method")
+}
+
+// socksReadRequest Read the command and destination of a request, rep is the reply code to send on error
+func socksReadRequest(r *bufio.Reader) (cmd byte, target schema.Target, rep byte, err error) {
+	var head [3]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return 0, target, socksRepGeneralFailure, errors.WithStack(err)
+	}
+	if head[0] != socksVersion {
+		return 0, target, socksRepGeneralFailure, errors.NewWithStack("Unsupported SOCKS version: " + strconv.Itoa(int(head[0])))
+	}
+	atyp, err := r.ReadByte()
+	if err != nil {
+		return 0, target, socksRepGeneralFailure, errors.WithStack(err)
+	}
+	var addrLen int
+	switch atyp {
+	case socksAtypIPv4:
+		addrLen = net.IPv4len
+	case socksAtypIPv6:
+		addrLen = net.IPv6len
+	case socksAtypDomain:
+		size, err := r.ReadByte()
+		if err != nil {
+			return 0, target, socksRepGeneralFailure, errors.WithStack(err)
+		}
+		addrLen = int(size)
+	default:
+		return 0, target, socksRepAtypNotSupported, errors.NewWithStack("Unsupported SOCKS address type: " + strconv.Itoa(int(atyp)))
+	}
+	raw := []byte{atyp}
+	if atyp == socksAtypDomain {
+		raw = append(raw, byte(addrLen))
+	}
+	start := len(raw)
+	raw = append(raw, make([]byte, addrLen+2)...)
+	if _, err = io.ReadFull(r, raw[start:]); err != nil {
+		return 0, target, socksRepGeneralFailure, errors.WithStack(err)
+	}
+	target, _, err = socksParseAddr(raw)
+	if err != nil {
+		return 0, target, socksRepGeneralFailure, err
+	}
+	return head[1], target, socksRepSucceeded, nil
+}
+
+// socksParseAddr Parse ATYP, DST.ADDR and DST.PORT at the start of b, returns their size
+func socksParseAddr(b []byte) (schema.Target, int, error) {
+	var target schema.Target
+	if len(b) < 1 {
+		return target, 0, errors.NewWithStack("Short SOCKS address")
+	}
+	var start, addrLen int
+	switch b[0] {
+	case socksAtypIPv4:
+		start, addrLen = 1, net.IPv4len
+	case socksAtypIPv6:
+		start, addrLen = 1, net.IPv6len
+	case socksAtypDomain:
+		if len(b) < 2 {
+			return target, 0, errors.NewWithStack("Short SOCKS address")
+		}
+		start, addrLen = 2, int(b[1])
+	default:
+		return target, 0, errors.NewWithStack("Unsupported SOCKS address type: " + strconv.Itoa(int(b[0])))
+	}
+	size := start + addrLen + 2
+	if len(b) < size {
+		return target, 0, errors.NewWithStack("Short SOCKS address")
+	}
+	if b[0] == socksAtypDomain {
+		target.Host = string(b[start : start+addrLen])
+	} else {
+		target.Host = net.IP(b[start : start+addrLen]).String()
+	}
+	target.Port = int(binary.BigEndian.Uint16(b[start+addrLen:]))
+	return target, size, nil
+}
+
+// socksAppendAddr Append target as ATYP, DST.ADDR and DST.PORT
+func socksAppendAddr(b []byte, target schema.Target) []byte {
+	if ip := net.ParseIP(target.Host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socksAtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socksAtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		b = append(b, socksAtypDomain, byte(len(target.Host)))
+		b = append(b, target.Host...)
+	}
+	return append(b, byte(target.Port>>8), byte(target.Port))
+}
+
+// socksWriteReply Send a reply with the bound address, 0.0.0.0:0 when addr is nil
+func socksWriteReply(w io.Writer, rep byte, addr net.Addr) error {
+	bound := schema.Target{Host: "0.0.0.0"}
+	if addr != nil {
+		host, port, err := net.SplitHostPort(addr.String())
+		if err == nil {
+			bound.Host = host
+			bound.Port, _ = strconv.Atoi(port)
+		}
+	}
+	_, err := w.Write(socksAppendAddr([]byte{socksVersion, rep, 0}, bound))
+	return err
+}
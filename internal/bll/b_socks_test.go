@@ -0,0 +1,143 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"net"
+	"testing"
+)
+
+func TestSocksAddrRoundTrip(t *testing.T) {
+	tests := []struct {
+		target schema.Target
+		atyp   byte
+	}{
+		{schema.Target{Host: "10.1.2.3", Port: 443}, socksAtypIPv4},
+		{schema.Target{Host: "2001:db8::1", Port: 53}, socksAtypIPv6},
+		{schema.Target{Host: "db.corp.com", Port: 65535}, socksAtypDomain},
+	}
+	for _, tt := range tests {
+		b := socksAppendAddr(nil, tt.target)
+		if b[0] != tt.atyp {
+			t.Errorf("%s: ATYP %d, want %d", tt.target.Host, b[0], tt.atyp)
+		}
+		got, size, err := socksParseAddr(append(b, "payload"...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.target || size != len(b) {
+			t.Errorf("parsed %+v of %d bytes, want %+v of %d", got, size, tt.target, len(b))
+		}
+	}
+}
+
+func TestSocksParseAddrMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"address type", []byte{0x02, 1, 2, 3, 4, 0, 80}},
+		{"short IPv4", []byte{socksAtypIPv4, 1, 2, 3, 4, 0}},
+		{"short IPv6", append([]byte{socksAtypIPv6}, make([]byte, 16)...)},
+		{"no domain length", []byte{socksAtypDomain}},
+		{"short domain", append([]byte{socksAtypDomain, 10}, "corp.com"...)},
+	}
+	for _, tt := range tests {
+		if target, _, err := socksParseAddr(tt.input); err == nil {
+			t.Errorf("%s: parsed %+v", tt.name, target)
+		}
+	}
+}
+
+func TestSocksUDPHeader(t *testing.T) {
+	target := schema.Target{Host: "10.0.0.53", Port: 53}
+	datagram := append(socksAppendAddr([]byte{0, 0, 0}, target), "query"...)
+	got, size, err := socksParseAddr(datagram[socksUDPHeaderLen:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != target || string(datagram[socksUDPHeaderLen+size:]) != "query" {
+		t.Errorf("parsed %+v with payload %q", got, datagram[socksUDPHeaderLen+size:])
+	}
+}
+
+func TestSocksNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		reply   []byte
+		wantErr bool
+	}{
+		{"no auth", []byte{5, 2, 2, 0}, []byte{5, socksMethodNoAuth}, false},
+		{"no acceptable method", []byte{5, 1, 2}, []byte{5, socksMethodNoAcceptable}, true},
+		{"version", []byte{4, 1, 0}, nil, true},
+		{"truncated methods", []byte{5, 3, 0}, nil, true},
+		{"empty", nil, nil, true},
+	}
+	for _, tt := range tests {
+		var reply bytes.Buffer
+		err := socksNegotiate(bufio.NewReader(bytes.NewReader(tt.input)), &reply)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+		if !bytes.Equal(reply.Bytes(), tt.reply) {
+			t.Errorf("%s: replied %x, want %x", tt.name, reply.Bytes(), tt.reply)
+		}
+	}
+}
+
+func TestSocksReadRequest(t *testing.T) {
+	input := append([]byte{5, socksCmdConnect, 0}, socksAppendAddr(nil, schema.Target{Host: "git.corp.com", Port: 22})...)
+	cmd, target, rep, err := socksReadRequest(bufio.NewReader(bytes.NewReader(input)))
+	if err != nil || cmd != socksCmdConnect || rep != socksRepSucceeded || target != (schema.Target{Host: "git.corp.com", Port: 22}) {
+		t.Errorf("read %d %+v %d %v", cmd, target, rep, err)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		rep   byte
+	}{
+		{"address type", []byte{5, socksCmdConnect, 0, 0x05, 1, 2}, socksRepAtypNotSupported},
+		{"version", []byte{4, socksCmdConnect, 0, socksAtypIPv4, 1, 2, 3, 4, 0, 80}, socksRepGeneralFailure},
+		{"truncated address", []byte{5, socksCmdConnect, 0, socksAtypIPv4, 1, 2}, socksRepGeneralFailure},
+		{"truncated domain", []byte{5, socksCmdConnect, 0, socksAtypDomain}, socksRepGeneralFailure},
+		{"truncated head", []byte{5, socksCmdConnect}, socksRepGeneralFailure},
+	}
+	for _, tt := range tests {
+		_, _, rep, err := socksReadRequest(bufio.NewReader(bytes.NewReader(tt.input)))
+		if err == nil || rep != tt.rep {
+			t.Errorf("%s: rep %d, err %v, want rep %d", tt.name, rep, err, tt.rep)
+		}
+	}
+}
+
+func TestSocksWriteReply(t *testing.T) {
+	var reply bytes.Buffer
+	if err := socksWriteReply(&reply, socksRepSucceeded, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{5, 0, 0, socksAtypIPv4, 127, 0, 0, 1, 0x04, 0x38}; !bytes.Equal(reply.Bytes(), want) {
+		t.Errorf("reply %x, want %x", reply.Bytes(), want)
+	}
+	reply.Reset()
+	if err := socksWriteReply(&reply, socksRepNotAllowed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{5, socksRepNotAllowed, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}; !bytes.Equal(reply.Bytes(), want) {
+		t.Errorf("reply %x, want %x", reply.Bytes(), want)
+	}
+}
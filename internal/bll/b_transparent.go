@@ -0,0 +1,48 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/internal/schema"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"net"
+)
+
+// handleTransparent Tunnel a connection redirected to the client to its original destination
+func (a *Client) handleTransparent(ctx context.Context, conf *schema.ClientConfig, clientConn net.Conn) {
+	ctx = newTraceContext(ctx)
+	defer closeClientConn(ctx, clientConn)
+	dst, err := originalDst(clientConn)
+	if err != nil {
+		logger.WithErrorStack(ctx, err).Errorf("Failed to get the original destination: %v", err)
+		return
+	}
+	// A connection made straight to the listener was not redirected, tunneling it would loop
+	if dst.Port == conf.Port && dst.String() == clientConn.LocalAddr().String() {
+		err = errors.NewWithStack("Connection was not redirected: " + dst.String())
+		logger.WithErrorStack(ctx, err).Error(err)
+		return
+	}
+	target := schema.Target{Host: dst.IP.String(), Port: dst.Port}
+	if target, err = a.verifyTarget(ctx, conf, schema.NetworkTCP, target); err != nil {
+		return
+	}
+	stream, err := a.openStream(ctx, conf, &schema.StreamHeader{Network: schema.NetworkTCP, Target: &target, Source: clientConn.RemoteAddr().String()})
+	if err != nil {
+		logger.WithErrorStack(ctx, err).Errorf("The client failed to request the lower level service. Procedure:Error:%v", err)
+		return
+	}
+	defer stream.Close()
+	a.recordSession(ctx, conf, targetAddr(target), TransparentProxy(clientConn, stream))
+}
@@ -0,0 +1,106 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package bll
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst SO_ORIGINAL_DST of linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST has the same value
+const soOriginalDst = 80
+
+// ipv6Transparent IPV6_TRANSPARENT of linux/in6.h, missing from syscall
+const ipv6Transparent = 75
+
+// listenTransparent Listen for redirected connections on network tcp, tcp4 or tcp6. IP_TRANSPARENT is
+// needed by TPROXY and requires CAP_NET_ADMIN, without it only REDIRECT works. IPv6 and dual-stack
+// sockets take IPV6_TRANSPARENT, which covers their IPv4-mapped connections too.
+func listenTransparent(ctx context.Context, network, addr string) (net.Listener, error) {
+	var sockErr error
+	lc := net.ListenConfig{
+		KeepAlive: tcpKeepAlive(),
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+					return
+				}
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+		},
+	}
+	ln, err := lc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if sockErr != nil {
+		logger.WithContext(ctx).Warnf("IP_TRANSPARENT unavailable, only REDIRECT is supported: %v", sockErr)
+	}
+	return ln, nil
+}
+
+// originalDst The destination of a connection before it was redirected. REDIRECT rewrites the
+// destination and keeps the original in conntrack, TPROXY keeps it as the local address.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.NewWithStack("Transparent mode requires a TCP connection")
+	}
+	local, _ := tcpConn.LocalAddr().(*net.TCPAddr)
+	rc, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr.Addr[:])
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+			return
+		}
+		// struct sockaddr_in fits in the 16 bytes of Multiaddr
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		addr := mreq.Multiaddr
+		dst = &net.TCPAddr{IP: net.IPv4(addr[4], addr[5], addr[6], addr[7]), Port: int(addr[2])<<8 | int(addr[3])}
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if sockErr != nil {
+		if local == nil {
+			return nil, errors.WithStack(sockErr)
+		}
+		// Not NATed, as with TPROXY
+		return local, nil
+	}
+	return dst, nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package bll
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"net"
+)
+
+func listenTransparent(ctx context.Context, network, addr string) (net.Listener, error) {
+	return nil, errors.NewWithStack("Transparent mode is only supported on Linux")
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.NewWithStack("Transparent mode is only supported on Linux")
+}
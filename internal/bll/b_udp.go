@@ -0,0 +1,298 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"encoding/binary"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDatagram Largest UDP payload
+const maxDatagram = 65535
+
+// writeDatagram Send one datagram on a stream, a 2 byte length followed by the payload
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagram {
+		return errors.NewWithStack("Datagram too large")
+	}
+	buf := make([]byte, 2, 2+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(len(p)))
+	buf = append(buf, p...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readDatagram Read one datagram from a stream into buf, which must hold maxDatagram bytes
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// udpIdleTimeout Time without datagrams after which a flow is expired
+func udpIdleTimeout() time.Duration {
+	if config.C.UDP.IdleTimeout > 0 {
+		return time.Duration(config.C.UDP.IdleTimeout) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// maxPendingDatagrams Datagrams held for a flow while its stream is opened, further ones are dropped
+const maxPendingDatagrams = 64
+
+// udpFlow A UDP flow carried by one tunnel stream, up is from the client to the resource. The stream
+// is nil while it is opened.
+type udpFlow struct {
+	stream     net.Conn
+	begin      time.Time
+	lastActive int64
+	bytesUp    int64
+	bytesDown  int64
+
+	mu      sync.Mutex
+	reason  string
+	pending [][]byte
+	closed  bool
+}
+
+func newUDPFlow(stream net.Conn) *udpFlow {
+	flow := &udpFlow{stream: stream, begin: time.Now()}
+	flow.touch()
+	return flow
+}
+
+func (a *udpFlow) touch() {
+	atomic.StoreInt64(&a.lastActive, time.Now().UnixNano())
+}
+
+// sent Account a datagram toward the resource
+func (a *udpFlow) sent(n int) {
+	a.touch()
+	atomic.AddInt64(&a.bytesUp, int64(n))
+}
+
+// received Account a datagram from the resource
+func (a *udpFlow) received(n int) {
+	a.touch()
+	atomic.AddInt64(&a.bytesDown, int64(n))
+}
+
+// end Record why the flow ended, the first reason is kept
+func (a *udpFlow) end(reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.reason == "" {
+		a.reason = reason
+	}
+}
+
+func (a *udpFlow) result() *ProxyResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return &ProxyResult{
+		BytesUp:   atomic.LoadInt64(&a.bytesUp),
+		BytesDown: atomic.LoadInt64(&a.bytesDown),
+		Duration:  time.Since(a.begin),
+		Reason:    a.reason,
+	}
+}
+
+// pend Hold a copy of p while the stream is opened, returns the stream once it is open.
+// nil when p was held or dropped.
+func (a *udpFlow) pend(p []byte) net.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stream != nil || a.closed {
+		return a.stream
+	}
+	if len(a.pending) < maxPendingDatagrams {
+		a.pending = append(a.pending, append([]byte(nil), p...))
+	}
+	return nil
+}
+
+// open Set the stream opened for the flow and send the datagrams held meanwhile. Returns false and
+// closes stream when the flow was closed first or sending failed.
+func (a *udpFlow) open(stream net.Conn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		_ = stream.Close()
+		return false
+	}
+	for _, p := range a.pending {
+		if err := writeDatagram(stream, p); err != nil {
+			if a.reason == "" {
+				a.reason = CloseReasonServerError
+			}
+			a.closed = true
+			_ = stream.Close()
+			return false
+		}
+		atomic.AddInt64(&a.bytesUp, int64(len(p)))
+	}
+	a.pending = nil
+	a.stream = stream
+	a.touch()
+	return true
+}
+
+// close Close the stream, a stream still being opened is closed by open
+func (a *udpFlow) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	a.pending = nil
+	if a.stream != nil {
+		_ = a.stream.Close()
+	}
+}
+
+func (a *udpFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.lastActive)))
+}
+
+// udpFlows Flows of a client UDP listener by source address
+type udpFlows struct {
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func newUDPFlows() *udpFlows {
+	return &udpFlows{
+		flows: make(map[string]*udpFlow),
+	}
+}
+
+func (a *udpFlows) get(key string) *udpFlow {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.flows[key]
+}
+
+func (a *udpFlows) add(key string, flow *udpFlow) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flows[key] = flow
+}
+
+// remove Remove the flow of key if it is still flow
+func (a *udpFlows) remove(key string, flow *udpFlow) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.flows[key] == flow {
+		delete(a.flows, key)
+	}
+}
+
+// expire Close the streams of the flows idle for longer than timeout
+func (a *udpFlows) expire(timeout time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, flow := range a.flows {
+		if flow.idle() > timeout {
+			flow.end(CloseReasonIdleTimeout)
+			flow.close()
+			delete(a.flows, key)
+		}
+	}
+}
+
+// close Close the streams of all flows
+func (a *udpFlows) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, flow := range a.flows {
+		flow.end(CloseReasonClientClosed)
+		flow.close()
+		delete(a.flows, key)
+	}
+}
+
+// UDPProxy Forward datagrams between a stream and a connected UDP socket until either
+// side ends or no datagram went through for the idle timeout
+func UDPProxy(stream, udpConn net.Conn) *ProxyResult {
+	flow := newUDPFlow(stream)
+	timeout := udpIdleTimeout()
+	done := make(chan struct{}, 2)
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				flow.end(CloseReasonServerError)
+				break
+			}
+			if err = writeDatagram(stream, buf[:n]); err != nil {
+				flow.end(CloseReasonClientError)
+				break
+			}
+			flow.received(n)
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := readDatagram(stream, buf)
+			if err == io.EOF {
+				flow.end(CloseReasonClientClosed)
+				break
+			}
+			if err != nil {
+				flow.end(CloseReasonClientError)
+				break
+			}
+			// Datagrams are lossy, a failed send does not end the flow
+			if _, err = udpConn.Write(buf[:n]); err == nil {
+				flow.sent(n)
+			}
+		}
+		done <- struct{}{}
+	}()
+	ticker := time.NewTicker(expireInterval(timeout))
+	defer ticker.Stop()
+	defer stream.Close()
+	defer udpConn.Close()
+	for {
+		select {
+		case <-done:
+			return flow.result()
+		case <-ticker.C:
+			if flow.idle() > timeout {
+				flow.end(CloseReasonIdleTimeout)
+				return flow.result()
+			}
+		}
+	}
+}
+
+// expireInterval How often idle flows are looked for
+func expireInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
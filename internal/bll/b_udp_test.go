@@ -0,0 +1,116 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bll
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	datagrams := [][]byte{{}, []byte("one"), bytes.Repeat([]byte{9}, maxDatagram)}
+	for _, p := range datagrams {
+		if err := writeDatagram(&stream, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, maxDatagram)
+	for _, p := range datagrams {
+		n, err := readDatagram(&stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], p) {
+			t.Errorf("read %d bytes, want %d", n, len(p))
+		}
+	}
+	if _, err := readDatagram(&stream, buf); err != io.EOF {
+		t.Errorf("read past the last datagram = %v, want EOF", err)
+	}
+}
+
+func TestDatagramMalformed(t *testing.T) {
+	if err := writeDatagram(io.Discard, make([]byte, maxDatagram+1)); err == nil {
+		t.Error("an oversized datagram was written")
+	}
+	buf := make([]byte, maxDatagram)
+	for _, input := range [][]byte{{0}, {0, 4, 'a', 'b'}} {
+		if _, err := readDatagram(bytes.NewReader(input), buf); err != io.ErrUnexpectedEOF {
+			t.Errorf("read %x = %v, want ErrUnexpectedEOF", input, err)
+		}
+	}
+}
+
+func TestUDPFlowPending(t *testing.T) {
+	flow := newUDPFlow(nil)
+	for i := 0; i < maxPendingDatagrams+2; i++ {
+		p := []byte{byte(i)}
+		if stream := flow.pend(p); stream != nil {
+			t.Fatal("pend returned a stream before it was opened")
+		}
+		// The flow holds a copy
+		p[0] = 0xff
+	}
+	stream := &bufConn{}
+	if !flow.open(stream) {
+		t.Fatal("open failed")
+	}
+	buf := make([]byte, maxDatagram)
+	for i := 0; i < maxPendingDatagrams; i++ {
+		n, err := readDatagram(&stream.w, buf)
+		if err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("held datagram %d read as %x, %v", i, buf[:n], err)
+		}
+	}
+	if stream.w.Len() != 0 {
+		t.Error("more datagrams than the limit were held")
+	}
+	if got := flow.result().BytesUp; got != maxPendingDatagrams {
+		t.Errorf("%d bytes up accounted, want %d", got, maxPendingDatagrams)
+	}
+	if flow.pend([]byte("next")) != stream {
+		t.Error("pend did not return the open stream")
+	}
+	flow.close()
+	if !stream.closed {
+		t.Error("close left the stream open")
+	}
+}
+
+func TestUDPFlowClosedWhileOpening(t *testing.T) {
+	flow := newUDPFlow(nil)
+	flow.pend([]byte("held"))
+	flow.close()
+	if flow.pend([]byte("late")) != nil {
+		t.Error("pend returned a stream of a closed flow")
+	}
+	stream := &bufConn{}
+	if flow.open(stream) {
+		t.Error("open succeeded on a closed flow")
+	}
+	if !stream.closed || stream.w.Len() != 0 {
+		t.Error("the stream opened for a closed flow was used or left open")
+	}
+
+	// A stream failing to take the held datagrams ends the flow
+	flow = newUDPFlow(nil)
+	flow.pend([]byte("held"))
+	stream = &bufConn{closed: true}
+	if flow.open(stream) {
+		t.Error("open succeeded on a failing stream")
+	}
+	if reason := flow.result().Reason; reason != CloseReasonServerError {
+		t.Errorf("reason %q, want %q", reason, CloseReasonServerError)
+	}
+}
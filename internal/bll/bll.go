@@ -12,20 +12,170 @@
 package bll
 
 import (
+	"context"
+	"github.com/ztalab/ZASentinel/internal/config"
+	"github.com/ztalab/ZASentinel/internal/event"
+	"github.com/ztalab/ZASentinel/internal/metrics"
+	"github.com/ztalab/ZASentinel/pkg/errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func TransparentProxy(clientConn, serverConn net.Conn) {
-	errChan := make(chan error, 2)
-	copyConn := func(a, b net.Conn) {
-		_, err := io.Copy(a, b)
-		errChan <- err
+// Reasons a proxied connection ended
+const (
+	CloseReasonClientClosed = "client closed"
+	CloseReasonServerClosed = "server closed"
+	CloseReasonClientError  = "client error"
+	CloseReasonServerError  = "server error"
+	CloseReasonIdleTimeout  = "idle timeout"
+	CloseReasonMaxLifetime  = "max lifetime"
+	CloseReasonHeartbeat    = "heartbeat timeout"
+)
+
+// proxyBufferSize Size of the copy buffer of each direction
+const proxyBufferSize = 32 * 1024
+
+// proxyBuffers Copy buffers of the proxied connections, reused as the connections come and go
+var proxyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, proxyBufferSize)
+		return &buf
+	},
+}
+
+// ProxyResult What a proxied connection carried and why it ended.
+// Up is from the client side to the server side.
+type ProxyResult struct {
+	BytesUp   int64
+	BytesDown int64
+	Duration  time.Duration
+	Reason    string
+}
+
+// closeWriter A connection that can shut down its writing side only
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite Shut down the writing side of conn, an error when it cannot half-close
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
 	}
-	go copyConn(clientConn, serverConn)
-	go copyConn(serverConn, clientConn)
-	select {
-	case <-errChan:
-		return
+	return errors.NewWithStack("the connection cannot half-close")
+}
+
+// TransparentProxy Copy between the two connections until both directions ended. The end of one
+// direction is passed on as a half-close when the other side supports it, otherwise both directions end.
+// The connections are closed by the caller.
+func TransparentProxy(clientConn, serverConn net.Conn) *ProxyResult {
+	begin := time.Now()
+	result := new(ProxyResult)
+	lastActive := begin.UnixNano()
+	var mu sync.Mutex
+	setReason := func(reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if result.Reason == "" {
+			result.Reason = reason
+		}
+	}
+	var abortOnce sync.Once
+	abort := func(reason string) {
+		setReason(reason)
+		abortOnce.Do(func() {
+			// Unblock both directions, closing is left to the caller
+			now := time.Now()
+			_ = clientConn.SetDeadline(now)
+			_ = serverConn.SetDeadline(now)
+		})
+	}
+	pipe := func(dst, src net.Conn, count *int64, readErr, writeErr, closed string) {
+		bufp := proxyBuffers.Get().(*[]byte)
+		defer proxyBuffers.Put(bufp)
+		buf := *bufp
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+				written, werr := dst.Write(buf[:n])
+				atomic.AddInt64(count, int64(written))
+				if werr != nil {
+					abort(writeErr)
+					return
+				}
+			}
+			if err == io.EOF {
+				setReason(closed)
+				if closeWrite(dst) != nil {
+					abort(closed)
+				}
+				return
+			}
+			if err != nil {
+				abort(readErr)
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pipe(serverConn, clientConn, &result.BytesUp, CloseReasonClientError, CloseReasonServerError, CloseReasonClientClosed)
+	}()
+	go func() {
+		defer wg.Done()
+		pipe(clientConn, serverConn, &result.BytesDown, CloseReasonServerError, CloseReasonClientError, CloseReasonServerClosed)
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var idleCheck, lifetime <-chan time.Time
+	idleTimeout := time.Duration(config.C.Proxy.IdleTimeout) * time.Second
+	if idleTimeout > 0 {
+		ticker := time.NewTicker(expireInterval(idleTimeout))
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+	if config.C.Proxy.MaxLifetime > 0 {
+		timer := time.NewTimer(time.Duration(config.C.Proxy.MaxLifetime) * time.Second)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	for {
+		select {
+		case <-done:
+			result.Duration = time.Since(begin)
+			return result
+		case <-lifetime:
+			abort(CloseReasonMaxLifetime)
+		case <-idleCheck:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) > idleTimeout {
+				abort(CloseReasonIdleTimeout)
+			}
+		}
+	}
+}
+
+// recordSession Emit the Disconnect event and the session metric of a proxied connection of the
+// client clientID to target, resourceID is empty where the resource is not known. id and name identify this hop.
+func recordSession(ctx context.Context, ev *event.Event, clientID, target, resourceID string, result *ProxyResult, id, name string) {
+	session := &event.Session{
+		Target:    target,
+		Resource:  resourceID,
+		BytesUp:   result.BytesUp,
+		BytesDown: result.BytesDown,
+		Duration:  result.Duration.String(),
+		Reason:    result.Reason,
 	}
+	ev.WithSession(session).Info(ctx)
+	metrics.AddSessionPoint(ctx, ev.Operator, clientID, target, resourceID, session.Reason, session.Duration, session.BytesUp, session.BytesDown, id, name)
 }
@@ -14,11 +14,11 @@ package client
 import (
 	"context"
 	"github.com/urfave/cli/v2"
+	"github.com/ztalab/ZASentinel/internal"
 	"github.com/ztalab/ZASentinel/pkg/logger"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 func NewCliCmd(ctx context.Context) *cli.Command {
@@ -31,11 +31,14 @@ func NewCliCmd(ctx context.Context) *cli.Command {
 	}
 }
 
+// Run Serve with f until a shutdown signal, the func returned by f is called once the ctx passed to it is done
 func Run(ctx context.Context, f func(ctx context.Context) (func(), error)) error {
 	state := 1
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	cleanFunc, err := f(ctx)
+	serveCtx, stopServing := context.WithCancel(ctx)
+	defer stopServing()
+	cleanFunc, err := f(serveCtx)
 	if err != nil {
 		return err
 	}
@@ -54,9 +57,9 @@ EXIT:
 		}
 	}
 
-	cleanFunc()
+	stopServing()
+	internal.Shutdown(ctx, sc, cleanFunc)
 	logger.WithContext(ctx).Infof("shutdown!")
-	time.Sleep(time.Second)
 	os.Exit(state)
 	return nil
 }
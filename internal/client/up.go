@@ -63,8 +63,9 @@ func UpCmd(ctx context.Context) *cli.Command {
 				if err != nil {
 					return nil, err
 				}
-				RunUp(ctx)
+				proxy := RunUp(ctx)
 				return func() {
+					proxy.Drain(ctx)
 					initCleanFunc()
 				}, nil
 			}
@@ -73,7 +74,9 @@ func UpCmd(ctx context.Context) *cli.Command {
 	}
 }
 
-func RunUp(ctx context.Context) {
+// RunUp Log in and start the client in the background, it stops accepting once ctx is done
+func RunUp(ctx context.Context) *bll.Client {
+	proxy := bll.NewClient()
 	up := NewUp()
 	fmt.Println("----------------------------------------------------------------------")
 	fmt.Println("------------------------Interactive UI Start--------------------------")
@@ -101,12 +104,13 @@ func RunUp(ctx context.Context) {
 			logger.Fatalf("%v", errors.New("Certificate error, not a client certificate"))
 		}
 
-		err = bll.NewClient().Listen(ctx, attr)
+		fmt.Println("########## start the client proxy #########")
+		err = proxy.Listen(ctx, attr)
 		if err != nil {
 			logger.Fatalf("%v", err)
 		}
-		fmt.Println("########## start the client proxy #########")
 	}()
+	return proxy
 }
 
 // printClients
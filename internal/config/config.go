@@ -158,6 +158,23 @@ func ParseConfigByEnv() error {
 	if v := os.Getenv("INFLUXDB_PRECISION"); v != "" {
 		C.Influxdb.Precision = v
 	}
+	// reverse
+	if v := os.Getenv("REVERSE_ENABLED"); v == "true" {
+		C.Reverse.Enabled = true
+	}
+	if v := os.Getenv("REVERSE_RELAYS"); v != "" {
+		C.Reverse.Relays = strings.Split(v, ",")
+	}
+	// client
+	if v := os.Getenv("CLIENT_MODE"); v != "" {
+		C.Client.Mode = v
+	}
+	if v := os.Getenv("CLIENT_HTTP_PROXY_ADDR"); v != "" {
+		C.Client.HTTPProxyAddr = v
+	}
+	if v := os.Getenv("CLIENT_DNS_ADDR"); v != "" {
+		C.Client.DNSAddr = v
+	}
 	return nil
 }
 
@@ -173,14 +190,27 @@ func PrintWithJSON() {
 }
 
 type Config struct {
-	RunMode      string
-	PrintConfig  bool
-	Common       Common
-	Machine      Machine
-	Log          Log
-	LogRedisHook LogRedisHook
-	Certificate  Certificate
-	Influxdb     Influxdb
+	RunMode       string
+	PrintConfig   bool
+	Common        Common
+	Machine       Machine
+	Log           Log
+	LogRedisHook  LogRedisHook
+	Certificate   Certificate
+	Influxdb      Influxdb
+	Reverse       Reverse
+	UDP           UDP
+	Client        Client
+	HealthCheck   HealthCheck
+	Limit         Limit
+	Admission     Admission
+	Proxy         Proxy
+	ProxyProtocol ProxyProtocol
+	Shutdown      Shutdown
+	Keepalive     Keepalive
+	Listeners     []Listener
+	Accept        Accept
+	Handshake     Handshake
 }
 
 func (c *Config) IsDebugMode() bool {
@@ -256,6 +286,181 @@ type Influxdb struct {
 	FlushSize           int
 }
 
+// Reverse Reverse-connect mode of the server: instead of listening, it registers outbound with relays
+type Reverse struct {
+	Enabled bool
+	// Relays Relay addresses host:port
+	Relays []string
+	// RetryInterval Seconds to wait before registering again after a failure
+	RetryInterval int
+}
+
+// UDP UDP resource forwarding
+type UDP struct {
+	// IdleTimeout Seconds without datagrams in either direction before a flow is expired
+	IdleTimeout int
+}
+
+// Client Local listener of the client
+type Client struct {
+	// Mode Empty forwards conf.Port to the fixed target, socks5 runs a SOCKS5 server on it,
+	// transparent accepts connections redirected to it by iptables/nftables (Linux only)
+	Mode string
+	// HTTPProxyAddr Address of the HTTP proxy listener eg:127.0.0.1:8118, disabled when empty
+	HTTPProxyAddr string
+	// DNSAddr Address of the DNS responder for dns resources eg:127.0.0.1:53, disabled when empty
+	DNSAddr string
+	// DNSPool CIDR the synthetic addresses handed out by the DNS responder come from
+	DNSPool string
+	// DNSTTL TTL in seconds of the answers of the DNS responder
+	DNSTTL int
+	// ProbeInterval Seconds between two TLS handshake probes of the relays and the server
+	ProbeInterval int
+	// ProbeTimeout Seconds a probe may take
+	ProbeTimeout int
+	// BreakerThreshold Consecutive failures after which a relay or the server is skipped
+	BreakerThreshold int
+	// BreakerCooldown Seconds a skipped relay or server waits before it is tried again
+	BreakerCooldown int
+}
+
+// IsSocks5 Whether the client port is a SOCKS5 server
+func (a *Client) IsSocks5() bool {
+	return a.Mode == "socks5"
+}
+
+// IsTransparent Whether the client port accepts redirected connections
+func (a *Client) IsTransparent() bool {
+	return a.Mode == "transparent"
+}
+
+// HealthCheck Active health checks of the members of server groups, by the client and the relays
+type HealthCheck struct {
+	// Interval Seconds between two checks of a member
+	Interval int
+	// Timeout Seconds a check may take
+	Timeout int
+}
+
+// Limit Bandwidth limits in bytes per second enforced by a relay or server, 0 is unlimited.
+// Upload is from the clients to the resources, Download the other way.
+type Limit struct {
+	// Upload Shared by all connections
+	Upload int64
+	// Download Shared by all connections
+	Download int64
+	// Clients Limits shared by the connections of a client, by client uuid
+	Clients map[string]Bandwidth
+}
+
+// Bandwidth Upload and download limits in bytes per second, 0 is unlimited
+type Bandwidth struct {
+	Upload   int64
+	Download int64
+}
+
+// Admission Limits on the connections accepted by a relay or server, 0 is unlimited.
+// An identity is the uuid of the peer certificate, the client or the previous relay.
+type Admission struct {
+	// MaxHandshakes TLS handshakes in flight
+	MaxHandshakes int
+	// MaxHandshakesPerIP TLS handshakes in flight from one source IP, the identity is not known before
+	MaxHandshakesPerIP int
+	// MaxConns Concurrent connections
+	MaxConns int
+	// MaxConnsPerIdentity Concurrent connections of one identity
+	MaxConnsPerIdentity int
+	// ConnRate New connections per second
+	ConnRate int
+	// ConnRatePerIdentity New connections per second of one identity
+	ConnRatePerIdentity int
+}
+
+// Proxy Timeouts of the proxied connections, 0 disables them. On relays a proxied connection is
+// a whole tunnel session.
+type Proxy struct {
+	// IdleTimeout Seconds without bytes in either direction before a connection is closed
+	IdleTimeout int
+	// MaxLifetime Seconds a connection may last
+	MaxLifetime int
+}
+
+// ProxyProtocol PROXY protocol headers sent by L4 load balancers in front of a relay or server
+type ProxyProtocol struct {
+	// Accept Read a v1 or v2 header first on the connections from Trusted, the address it carries is the source
+	Accept bool
+	// Trusted CIDRs of the load balancers, their connections must start with a header. Required with Accept
+	Trusted []string
+	// HeaderTimeout Seconds to wait for the header
+	HeaderTimeout int
+}
+
+// Shutdown Draining on SIGTERM, SIGINT or SIGQUIT: the listeners stop accepting and the proxied connections
+// in flight may end before the metrics and logs are flushed
+type Shutdown struct {
+	// DrainTimeout Seconds to wait for the proxied connections in flight, 30 when 0
+	DrainTimeout int
+}
+
+// Listener An address the client, relay or server listens on. Without any the role listens on all IPv4
+// interfaces at the port of its certificate.
+type Listener struct {
+	// Network tcp, tcp4, tcp6 or unix (clients only), tcp when empty
+	Network string
+	// Address host:port, an empty host or :: listens on both stacks and an empty or zero port takes the port
+	// of the certificate. The socket path with unix.
+	Address string
+	// CertPemPath KeyPemPath CaPemPath TLS certificate, key and CA of a relay or server listener, those of
+	// [Certificate] when empty
+	CertPemPath string
+	KeyPemPath  string
+	CaPemPath   string
+	// MinVersion Lowest TLS version of a relay or server listener, 1.2 or 1.3, 1.2 when empty
+	MinVersion string
+}
+
+// Accept Accepting of the connections of the previous hops by relays and servers
+type Accept struct {
+	// Acceptors Sockets per listener sharing the address with SO_REUSEPORT, each with its own accept loop
+	// (Linux only), 1 when 0
+	Acceptors int
+	// HandshakeWorkers TLS handshakes run at once, 16 per CPU when 0
+	HandshakeWorkers int
+	// HandshakeQueue Accepted connections waiting for a handshake worker before the accept loops wait, as many
+	// as the workers when 0
+	HandshakeQueue int
+}
+
+// Handshake Limits on the handshake of a previous hop with a relay or server, a peer exceeding them is
+// disconnected instead of holding the connection
+type Handshake struct {
+	// TLSTimeout Seconds to complete the TLS handshake, 10 when 0
+	TLSTimeout int
+	// RequestTimeout Seconds to send the websocket request once the TLS handshake completed, 10 when 0
+	RequestTimeout int
+	// ReadyTimeout Seconds to send the certificate verification result once the request was answered, and for
+	// the end-to-end TLS handshake of servers, 10 when 0
+	ReadyTimeout int
+	// WriteTimeout Seconds to take the response to the request, 10 when 0
+	WriteTimeout int
+	// MaxHeaderBytes Size of the request line and headers, 64 KiB when 0
+	MaxHeaderBytes int
+	// MaxChainsBytes Size of the X-Chains header, 32 KiB when 0
+	MaxChainsBytes int
+	// DialTimeout Seconds to connect to the next hop or a resource, 10 when 0
+	DialTimeout int
+}
+
+// Keepalive Liveness of the tunnels, dead peers behind NATs are torn down instead of lingering
+type Keepalive struct {
+	// Interval Seconds between two keepalive frames of the tunnels and heartbeats of the relays, 10 when 0
+	Interval int
+	// Timeout Seconds without anything from the peer before a tunnel is torn down, 30 when 0, at least three intervals
+	Timeout int
+	// TCP Seconds between two TCP keepalive probes of the dialed and accepted sockets, 15 when 0, disabled when negative
+	TCP int
+}
+
 // Machine
 type Machine struct {
 	MachineId string
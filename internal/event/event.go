@@ -27,6 +27,12 @@ const (
 	TagClientTLSFail    = "Client tls invalid"
 	TagServerTLSFail    = "Server tls invalid"
 	TagResourceNotFound = "Resource not found"
+	TagServerRegister   = "Server register"
+	TagServerUnregister = "Server unregister"
+	TagHopDown          = "Hop down"
+	TagHopUp            = "Hop up"
+	TagAdmissionReject  = "Admission reject"
+	TagDisconnect       = "Disconnect"
 )
 
 type Event struct {
@@ -36,6 +42,17 @@ type Event struct {
 	RelayInfo  *schema.RelayConfig  `json:"relay_info"`
 	Tag        string               `json:"tag"`
 	MsgInfo    string               `json:"msg_info"`
+	Session    *Session             `json:"session,omitempty"`
+}
+
+// Session Accounting of a proxied connection, up is from the client to the resource
+type Session struct {
+	Target    string `json:"target,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	BytesUp   int64  `json:"bytes_up"`
+	BytesDown int64  `json:"bytes_down"`
+	Duration  string `json:"duration"`
+	Reason    string `json:"reason"`
 }
 
 func NewClientEvent(clientInfo *schema.ClientConfig, tag, msgInfo string) *Event {
@@ -67,6 +84,12 @@ func NewServerEvent(clientInfo *schema.ClientConfig, serverInfo *schema.ServerCo
 	}
 }
 
+// WithSession Attach the accounting of a proxied connection
+func (a *Event) WithSession(session *Session) *Event {
+	a.Session = session
+	return a
+}
+
 func (a *Event) Info(ctx context.Context) {
 	a.toLog(ctx, logrus.InfoLevel)
 }
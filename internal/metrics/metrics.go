@@ -17,14 +17,44 @@ import (
 	"github.com/ztalab/ZASentinel/pkg/errors"
 	"github.com/ztalab/ZASentinel/pkg/influxdb"
 	"github.com/ztalab/ZASentinel/pkg/logger"
+	"github.com/ztalab/ZASentinel/pkg/pconst"
 )
 
 const (
 	ReqSuccess = "success"
 	ReqFail    = "fail"
 
-	Prefix     = "za-sentinel"
-	MetricsReq = Prefix + "req"
+	Prefix      = "za-sentinel"
+	MetricsReq  = Prefix + "req"
+	MetricsPath = Prefix + "path"
+	// MetricsThrottle Time connections waited for a bandwidth limit
+	MetricsThrottle = Prefix + "throttle"
+	// MetricsSession Accounting of the proxied connections
+	MetricsSession = Prefix + "session"
+	// MetricsReject Handshakes of previous hops a relay or server rejected, by reason
+	MetricsReject = Prefix + "reject"
+)
+
+// Reasons of the rejected handshakes
+const (
+	// RejectTLS The TLS handshake failed or was not completed in time
+	RejectTLS = "tls"
+	// RejectRequestTimeout The websocket request did not arrive in time
+	RejectRequestTimeout = "request_timeout"
+	// RejectWriteTimeout The previous hop did not take the response in time
+	RejectWriteTimeout = "write_timeout"
+	// RejectReadyTimeout The certificate verification result or the end-to-end TLS handshake did not arrive in time
+	RejectReadyTimeout = "ready_timeout"
+	// RejectPreamble The connection does not start with the websocket request
+	RejectPreamble = "preamble"
+	// RejectHeaderSize The request line and headers exceed the limit
+	RejectHeaderSize = "header_size"
+	// RejectChainsSize X-Chains exceeds the limit
+	RejectChainsSize = "chains_size"
+	// RejectMalformed The request or its headers are invalid
+	RejectMalformed = "malformed"
+	// RejectProxyHeader The PROXY protocol header of a load balancer is invalid or did not arrive in time
+	RejectProxyHeader = "proxy_header"
 )
 
 type Metrics struct {
@@ -63,3 +93,129 @@ func AddDelayPoint(ctx context.Context, operator, status, delay, id, name string
 		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to add sequence logs. Procedure：%v", err)
 	}
 }
+
+// AddPathPoint Record the probe of a relay or server the client enters the chain through
+func AddPathPoint(ctx context.Context, status, rtt string, successRate float64, breaker, hopID, hopName, id, name string) {
+	if !config.C.Influxdb.Enabled {
+		return
+	}
+	fields := make(map[string]interface{})
+	fields["rtt"] = rtt
+	fields["status"] = status
+	fields["success_rate"] = successRate
+	fields["breaker"] = breaker
+
+	tags := make(map[string]string)
+	tags["pod_ip"] = config.C.Common.PodIP
+	tags["unique_id"] = config.C.Common.UniqueID
+	tags["hostname"] = config.C.Common.Hostname
+	tags["app_name"] = config.C.Common.AppName
+	tags["operator"] = pconst.OperatorClient
+	tags["id"] = id
+	tags["name"] = name
+	tags["hop_id"] = hopID
+	tags["hop_name"] = hopName
+
+	err := config.Is.Metrics.AddPoint(&influxdb.MetricsData{
+		Measurement: MetricsPath,
+		Fields:      fields,
+		Tags:        tags,
+	})
+	if err != nil {
+		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to add sequence logs. Procedure：%v", err)
+	}
+}
+
+// AddThrottlePoint Record that a connection waited for the bandwidth limit of scope (global, client
+// or resource) limitID in direction (upload or download)
+func AddThrottlePoint(ctx context.Context, operator, direction, scope, limitID, wait string, rate int64, id, name string) {
+	if !config.C.Influxdb.Enabled {
+		return
+	}
+	fields := make(map[string]interface{})
+	fields["wait"] = wait
+	fields["rate"] = rate
+
+	tags := make(map[string]string)
+	tags["pod_ip"] = config.C.Common.PodIP
+	tags["unique_id"] = config.C.Common.UniqueID
+	tags["hostname"] = config.C.Common.Hostname
+	tags["app_name"] = config.C.Common.AppName
+	tags["operator"] = operator
+	tags["id"] = id
+	tags["name"] = name
+	tags["direction"] = direction
+	tags["scope"] = scope
+	tags["limit_id"] = limitID
+
+	err := config.Is.Metrics.AddPoint(&influxdb.MetricsData{
+		Measurement: MetricsThrottle,
+		Fields:      fields,
+		Tags:        tags,
+	})
+	if err != nil {
+		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to add sequence logs. Procedure：%v", err)
+	}
+}
+
+// AddSessionPoint Record a finished proxied connection of the client clientID to target, of resourceID when known
+func AddSessionPoint(ctx context.Context, operator, clientID, target, resourceID, reason, duration string, bytesUp, bytesDown int64, id, name string) {
+	if !config.C.Influxdb.Enabled {
+		return
+	}
+	fields := make(map[string]interface{})
+	fields["bytes_up"] = bytesUp
+	fields["bytes_down"] = bytesDown
+	fields["duration"] = duration
+	fields["target"] = target
+
+	tags := make(map[string]string)
+	tags["pod_ip"] = config.C.Common.PodIP
+	tags["unique_id"] = config.C.Common.UniqueID
+	tags["hostname"] = config.C.Common.Hostname
+	tags["app_name"] = config.C.Common.AppName
+	tags["operator"] = operator
+	tags["id"] = id
+	tags["name"] = name
+	tags["client_id"] = clientID
+	tags["resource_id"] = resourceID
+	tags["reason"] = reason
+
+	err := config.Is.Metrics.AddPoint(&influxdb.MetricsData{
+		Measurement: MetricsSession,
+		Fields:      fields,
+		Tags:        tags,
+	})
+	if err != nil {
+		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to add sequence logs. Procedure：%v", err)
+	}
+}
+
+// AddRejectPoint Record a handshake of a previous hop rejected for reason, one of the Reject reasons
+func AddRejectPoint(ctx context.Context, operator, reason, remoteAddr, id, name string) {
+	if !config.C.Influxdb.Enabled {
+		return
+	}
+	fields := make(map[string]interface{})
+	fields["count"] = 1
+	fields["remote_addr"] = remoteAddr
+
+	tags := make(map[string]string)
+	tags["pod_ip"] = config.C.Common.PodIP
+	tags["unique_id"] = config.C.Common.UniqueID
+	tags["hostname"] = config.C.Common.Hostname
+	tags["app_name"] = config.C.Common.AppName
+	tags["operator"] = operator
+	tags["id"] = id
+	tags["name"] = name
+	tags["reason"] = reason
+
+	err := config.Is.Metrics.AddPoint(&influxdb.MetricsData{
+		Measurement: MetricsReject,
+		Fields:      fields,
+		Tags:        tags,
+	})
+	if err != nil {
+		logger.WithErrorStack(ctx, errors.WithStack(err)).Errorf("Failed to add sequence logs. Procedure：%v", err)
+	}
+}
@@ -28,6 +28,8 @@ type ClientConfig struct {
 	Server    Server    `json:"server"`
 	Target    Target    `json:"target"`
 	Resources Resources `json:"resources"`
+	// ServerGroup Optional servers sharing the resources, Server is the preferred member
+	ServerGroup *ServerGroup `json:"server_group,omitempty"`
 }
 
 type Relay struct {
@@ -45,6 +47,37 @@ type Server struct {
 	Host    string `json:"host"`
 	Port    int    `json:"port"`
 	OutPort int    `json:"out_port"`
+	// Fingerprint Optional hex SHA-256 of the server certificate the end-to-end TLS session is pinned to
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Load balancing policies of a server group
+const (
+	PolicyRoundRobin = "round_robin"
+	PolicyLeastConn  = "least_conn"
+	PolicyPriority   = "priority"
+)
+
+type ServerGroup struct {
+	// Policy round_robin, least_conn or priority, round_robin when empty
+	Policy  string         `json:"policy"`
+	Servers []*GroupServer `json:"servers"`
+}
+
+type GroupServer struct {
+	Server
+	// Priority Lower is preferred by the priority policy
+	Priority int `json:"priority"`
+}
+
+// Member The member server uuid, nil when it is not in the group
+func (a *ServerGroup) Member(uuid string) *GroupServer {
+	for _, item := range a.Servers {
+		if item.UUID == uuid {
+			return item
+		}
+	}
+	return nil
 }
 
 type Target struct {
@@ -79,6 +112,16 @@ func ParseClientConfig(attrs map[string]interface{}) (*ClientConfig, error) {
 		// Reply sort
 		result.RelaysAscBySort()
 	}
+	if result.Server.Host == "" && result.ServerGroup != nil && len(result.ServerGroup.Servers) > 0 {
+		// The most preferred member stands for the group
+		preferred := result.ServerGroup.Servers[0]
+		for _, item := range result.ServerGroup.Servers {
+			if item.Priority < preferred.Priority {
+				preferred = item
+			}
+		}
+		result.Server = preferred.Server
+	}
 	if result.Server.Host == "" {
 		err := errors.New("server Addr argument is missing")
 		return nil, errors.WithStack(err)
@@ -90,6 +133,33 @@ func (a *ClientConfig) ToJSONString() string {
 	return json.MarshalToString(a)
 }
 
+// WithServer Copy of the configuration going to server
+func (a *ClientConfig) WithServer(server Server) *ClientConfig {
+	conf := *a
+	conf.Server = server
+	return &conf
+}
+
+// ServerMembers The servers the client may end up at, the group members or Server
+func (a *ClientConfig) ServerMembers() []Server {
+	if a.ServerGroup == nil || len(a.ServerGroup.Servers) == 0 {
+		return []Server{a.Server}
+	}
+	members := make([]Server, 0, len(a.ServerGroup.Servers))
+	for _, item := range a.ServerGroup.Servers {
+		members = append(members, item.Server)
+	}
+	return members
+}
+
+// VerifyTarget Verify that target is granted to the client over network, either as its fixed TCP target or by its resources
+func (a *ClientConfig) VerifyTarget(network string, target Target) bool {
+	if network == NetworkTCP && a.Target.Host != "" && a.Target == target {
+		return true
+	}
+	return a.Resources.VerifyNetworkResources(network, target)
+}
+
 // RelaysAscBySort
 func (a *ClientConfig) RelaysAscBySort() {
 	sort.Slice(a.Relays, func(i, j int) bool { // asc
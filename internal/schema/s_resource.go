@@ -17,52 +17,119 @@ import (
 	"strings"
 )
 
+const (
+	NetworkTCP = "tcp"
+	NetworkUDP = "udp"
+)
+
+// PROXY protocol versions a resource may be sent
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// TLV types of the PROXY protocol v2 header sent to resources, in the range reserved for custom use
+const (
+	// ProxyTLVClientUUID UUID of the client
+	ProxyTLVClientUUID = 0xE0
+	// ProxyTLVIdentity Common name of the client certificate
+	ProxyTLVIdentity = 0xE1
+)
+
 type Resource struct {
 	UUID string `json:"uuid"`
 	Name string `json:"name"`
 	Type string `json:"type"`
 	Host string `json:"host"`
 	Port string `json:"port"`
+	// Protocol Allowed networks eg:tcp;udp, tcp only when empty
+	Protocol string `json:"protocol"`
+	// UploadLimit Bytes per second from the clients to the resource, shared by all connections, 0 is unlimited
+	UploadLimit int64 `json:"upload_limit"`
+	// DownloadLimit Bytes per second from the resource to the clients, shared by all connections, 0 is unlimited
+	DownloadLimit int64 `json:"download_limit"`
+	// ProxyProtocol PROXY protocol header sent first on tcp connections to the resource, v1 or v2, none when
+	// empty. It carries the address of the original client, v2 also the client UUID and identity TLVs.
+	ProxyProtocol string `json:"proxy_protocol"`
 }
 
 type Resources []*Resource
 
 // Verify that the access resource exists
 func (a Resources) VerifyResources(target Target) bool {
+	return a.VerifyNetworkResources(NetworkTCP, target)
+}
+
+// VerifyNetworkResources Verify that the access resource exists and allows the network
+func (a Resources) VerifyNetworkResources(network string, target Target) bool {
+	return a.MatchResource(network, target) != nil
+}
+
+// MatchResource The first resource allowing target over network, nil when there is none
+func (a Resources) MatchResource(network string, target Target) *Resource {
 	isIP := false
 	pip := net.ParseIP(target.Host)
 	if pip != nil {
 		isIP = true
 	}
 	for _, item := range a {
+		if !item.AllowNetwork(network) {
+			continue
+		}
 		if item.Host == "*" {
-			return true
+			return item
 		}
 		// dns validation
-		if item.Type == "dns" && !isIP {
-			if item.Host == target.Host &&
-				item.CheckPort(target.Port) {
-				return true
-			}
-			if item.CheckPort(target.Port) && strings.Index(item.Host, "*.") == 0 &&
-				(strings.Contains(target.Host, item.Host[1:]) || item.Host[2:] == target.Host) {
-				return true
-			}
+		if item.Type == "dns" && !isIP && item.CheckPort(target.Port) && matchDomain(item.Host, target.Host) {
+			return item
 		}
 		if item.Type == "cidr" && isIP && item.CheckPort(target.Port) {
 			_, subnet, err := net.ParseCIDR(item.Host)
 			if err != nil {
 				// Resource restriction non-CIDR, direct comparison
 				if target.Host == item.Host {
-					return true
+					return item
 				}
 				continue // The IP address does not match and is skipped
 			}
 			if subnet.Contains(pip) {
-				return true
+				return item
 			}
 		}
 	}
+	return nil
+}
+
+// MatchDomain Whether name is a dns resource, exactly or by a *. wildcard, whatever the port
+func (a Resources) MatchDomain(name string) bool {
+	for _, item := range a {
+		if item.Type == "dns" && matchDomain(item.Host, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain Whether name is host, or below it when host is a *. wildcard. Case and a trailing dot are ignored.
+func matchDomain(host, name string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if host == name {
+		return true
+	}
+	return strings.Index(host, "*.") == 0 && (strings.HasSuffix(name, host[1:]) || host[2:] == name)
+}
+
+// AllowNetwork Checking the allowed networks eg:tcp;udp
+func (a *Resource) AllowNetwork(network string) bool {
+	if a.Protocol == "" {
+		return network == NetworkTCP
+	}
+	for _, item := range strings.FieldsFunc(a.Protocol, func(r rune) bool { return r == ';' || r == ',' }) {
+		if strings.EqualFold(strings.TrimSpace(item), network) {
+			return true
+		}
+	}
 	return false
 }
 
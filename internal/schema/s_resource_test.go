@@ -0,0 +1,77 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"testing"
+)
+
+func TestMatchResource(t *testing.T) {
+	resources := Resources{
+		{UUID: "wildcard", Type: "dns", Host: "*.corp.com", Port: "443"},
+		{UUID: "exact", Type: "dns", Host: "git.example.com", Port: "22;80"},
+		{UUID: "cidr", Type: "cidr", Host: "10.0.0.0/8", Port: "1000-2000", Protocol: "tcp;udp"},
+	}
+	tests := []struct {
+		network string
+		host    string
+		port    int
+		want    string
+	}{
+		{NetworkTCP, "intranet.corp.com", 443, "wildcard"},
+		{NetworkTCP, "a.b.corp.com", 443, "wildcard"},
+		{NetworkTCP, "corp.com", 443, "wildcard"},
+		{NetworkTCP, "Intranet.CORP.com.", 443, "wildcard"},
+		{NetworkTCP, "intranet.corp.com.attacker.net", 443, ""},
+		{NetworkTCP, "evilcorp.com", 443, ""},
+		{NetworkTCP, "intranet.corp.com", 80, ""},
+		{NetworkUDP, "intranet.corp.com", 443, ""},
+		{NetworkTCP, "git.example.com", 80, "exact"},
+		{NetworkTCP, "GIT.example.com", 22, "exact"},
+		{NetworkTCP, "x.git.example.com", 22, ""},
+		{NetworkUDP, "10.1.2.3", 1500, "cidr"},
+		{NetworkTCP, "10.1.2.3", 2500, ""},
+		{NetworkTCP, "11.1.2.3", 1500, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if item := resources.MatchResource(tt.network, Target{Host: tt.host, Port: tt.port}); item != nil {
+			got = item.UUID
+		}
+		if got != tt.want {
+			t.Errorf("MatchResource(%s, %s:%d) = %q, want %q", tt.network, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	resources := Resources{
+		{Type: "dns", Host: "*.corp.com"},
+		{Type: "cidr", Host: "10.0.0.0/8"},
+	}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"intranet.corp.com", true},
+		{"intranet.corp.com.", true},
+		{"corp.com", true},
+		{"intranet.corp.com.attacker.net", false},
+		{"evilcorp.com", false},
+		{"10.0.0.0/8", false},
+	}
+	for _, tt := range tests {
+		if got := resources.MatchDomain(tt.name); got != tt.want {
+			t.Errorf("MatchDomain(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -20,10 +20,22 @@ func (t StatusText) String() string {
 
 // NextServer
 type NextServer struct {
+	UUID string
 	Host string
 	Port string
 }
 
+// StreamHeader Sent first on every tunnel stream, describes the connection it carries
+type StreamHeader struct {
+	Network string `json:"network"`
+	// Target Destination of the stream, the target of the session when empty
+	Target *Target `json:"target,omitempty"`
+	// HalfClose TCP data follows in frames so that either direction can end on its own
+	HalfClose bool `json:"half_close,omitempty"`
+	// Source Address of the original client at the client, host:port
+	Source string `json:"source,omitempty"`
+}
+
 // ControCommonResult
 type ControCommonResult struct {
 	Code    int    `json:"code"`
@@ -0,0 +1,115 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package internal
+
+import (
+	"context"
+	"github.com/ztalab/ZASentinel/internal/bll"
+	"github.com/ztalab/ZASentinel/pkg/errors"
+	"github.com/ztalab/ZASentinel/pkg/logger"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeSignal Signal asking for a zero-downtime upgrade to the binary now at the path of the executable
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// upgradeReadyEnv Environment variable naming the fd the new binary reports its start on
+const upgradeReadyEnv = "ZAS_UPGRADE_READY"
+
+// upgradeReadyTimeout How long the new binary may take to start
+const upgradeReadyTimeout = 30 * time.Second
+
+// upgrade Start the binary at the path of this executable with the same arguments, handing it the
+// listening sockets. Returns once it started, this process then stops accepting and drains.
+func upgrade(ctx context.Context) error {
+	path, err := os.Executable()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	files, names, err := bll.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer readyR.Close()
+
+	var env []string
+	for _, item := range os.Environ() {
+		if !strings.HasPrefix(item, bll.InheritedListenersEnv+"=") && !strings.HasPrefix(item, upgradeReadyEnv+"=") {
+			env = append(env, item)
+		}
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(env,
+		bll.InheritedListenersEnv+"="+names,
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			return errors.Wrap(err, "the new binary exited before it started")
+		}
+	case err = <-exited:
+		return errors.Wrap(err, "the new binary exited before it started")
+	case <-time.After(upgradeReadyTimeout):
+		_ = cmd.Process.Kill()
+		return errors.NewWithStack("the new binary did not start in " + upgradeReadyTimeout.String())
+	}
+	logger.WithContext(ctx).Infof("Handed the listeners %s over to the new binary, process number：%d", names, cmd.Process.Pid)
+	return nil
+}
+
+// notifyUpgradeReady Tell the previous binary that this one started, when it was started by upgrade
+func notifyUpgradeReady() {
+	value := os.Getenv(upgradeReadyEnv)
+	_ = os.Unsetenv(upgradeReadyEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade ready")
+	_, _ = f.Write([]byte{1})
+	_ = f.Close()
+}
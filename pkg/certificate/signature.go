@@ -0,0 +1,66 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certificate
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+)
+
+// challengeContext Prefix of every signed challenge, so that signatures cannot be reused elsewhere
+const challengeContext = "ZASentinel challenge\x00"
+
+// NewChallenge Create a random challenge
+func NewChallenge(size int) ([]byte, error) {
+	challenge := make([]byte, size)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// SignChallenge Sign a challenge with the private key of a certificate
+func SignChallenge(signer crypto.Signer, challenge []byte) ([]byte, error) {
+	msg := append([]byte(challengeContext), challenge...)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// VerifyChallenge Verify a challenge signature against the public key of cert
+func VerifyChallenge(cert *x509.Certificate, challenge, signature []byte) error {
+	msg := append([]byte(challengeContext), challenge...)
+	digest := sha256.Sum256(msg)
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return errors.New("ecdsa: invalid challenge signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, msg, signature) {
+			return errors.New("ed25519: invalid challenge signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported public key type")
+}
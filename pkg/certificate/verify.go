@@ -47,11 +47,7 @@ func (a *verifyCert) expectAuthorityUnknown(err error) error {
 
 // certificateFromPEM analytical certificate
 func (a *verifyCert) certificateFromPEM(pemBytes string) (*x509.Certificate, error) {
-	block, _ := pem.Decode([]byte(pemBytes))
-	if block == nil {
-		return nil, errors.New("failed to decode PEM")
-	}
-	return x509.ParseCertificate(block.Bytes)
+	return ParseCertificate(pemBytes)
 }
 
 func (a *verifyCert) Verify() error {
@@ -85,3 +81,12 @@ func (a *verifyCert) Verify() error {
 	}
 	return nil
 }
+
+// ParseCertificate Parse a PEM encoded certificate
+func ParseCertificate(pemBytes string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(pemBytes))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -23,6 +23,7 @@ var (
 	WithStack    = errors.WithStack
 	WithMessage  = errors.WithMessage
 	WithMessagef = errors.WithMessagef
+	As           = errors.As
 )
 
 var NewWithStack = func(msg string) error {
@@ -32,6 +32,7 @@ type Metrics struct {
 	flushTimer         *time.Ticker
 	InfluxDBHttpClient *HTTPClient
 	counter            uint64
+	flushReq           chan chan error
 }
 
 // MetricsData ...
@@ -60,6 +61,7 @@ func NewMetrics(influxDBHttpClient *HTTPClient, conf *CustomConfig) (*Metrics, e
 		point:              make(chan *client.Point, 16),
 		flushTimer:         time.NewTicker(time.Duration(conf.FlushTime) * time.Second),
 		InfluxDBHttpClient: influxDBHttpClient,
+		flushReq:           make(chan chan error),
 	}
 	go metrics.worker()
 	return metrics, nil
@@ -88,10 +90,28 @@ func (mt *Metrics) worker() {
 			}
 		case <-mt.flushTimer.C:
 			mt.flush()
+		case done := <-mt.flushReq:
+			// Points still queued belong to the batch
+			for queued := true; queued; {
+				select {
+				case p := <-mt.point:
+					mt.batchPoints.AddPoint(p)
+				default:
+					queued = false
+				}
+			}
+			done <- mt.flush()
 		}
 	}
 }
 
+// Flush Write the points added so far
+func (mt *Metrics) Flush() error {
+	done := make(chan error, 1)
+	mt.flushReq <- done
+	return <-done
+}
+
 func (mt *Metrics) flush() error {
 	mt.mu.Lock()
 	defer mt.mu.Unlock()
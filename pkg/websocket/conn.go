@@ -0,0 +1,371 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Opcodes, RFC 6455 section 5.2
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// Close codes, RFC 6455 section 7.4.1
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	ClosePolicyViolation  = 1008
+	CloseMessageTooBig    = 1009
+	CloseInternalError    = 1011
+)
+
+const (
+	finBit  = 0x80
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	maxControlPayload = 125
+	// DefaultMaxPayload Largest data frame accepted unless changed with SetReadLimit
+	DefaultMaxPayload = 1 << 20
+	closeWriteTimeout = time.Second
+)
+
+var ErrProtocol = errors.New("websocket: protocol error")
+
+// CloseError is returned by Read when the peer closed with an abnormal code
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// Conn A websocket connection carrying binary messages, exposed as a byte stream
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isClient bool
+
+	// read state, only used by the reading goroutine
+	readLimit int64
+	remaining int64
+	maskKey   [4]byte
+	masked    bool
+	maskPos   int
+	readErr   error
+
+	writeMu   sync.Mutex
+	closeSent bool
+	closeOnce sync.Once
+	onPing    func([]byte)
+	onPong    func([]byte)
+}
+
+// NewConn Wrap an upgraded connection. br may hold bytes already buffered
+// during the handshake, nil creates a new reader.
+func NewConn(conn net.Conn, br *bufio.Reader, isClient bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:      conn,
+		br:        br,
+		isClient:  isClient,
+		readLimit: DefaultMaxPayload,
+	}
+}
+
+// SetReadLimit Set the maximum payload size of a single frame
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetPingHandler Set a callback invoked for every ping received, before it is answered
+func (c *Conn) SetPingHandler(h func(appData []byte)) {
+	c.onPing = h
+}
+
+// SetPongHandler Set a callback invoked for every pong received
+func (c *Conn) SetPongHandler(h func(appData []byte)) {
+	c.onPong = h
+}
+
+// NetConn Return the underlying connection
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		c.maskPos = maskBytes(c.maskKey, c.maskPos, p[:n])
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+// nextFrame Read the next frame header, handling control frames in place
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+	fin := head[0]&finBit != 0
+	opcode := head[0] & 0x0f
+	masked := head[1]&maskBit != 0
+	length := int64(head[1] & 0x7f)
+
+	if head[0]&rsvBits != 0 {
+		return c.failProtocol("reserved bits set")
+	}
+	if masked == c.isClient {
+		return c.failProtocol("bad mask bit")
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return c.failProtocol("bad payload length")
+		}
+	}
+	c.masked = masked
+	c.maskPos = 0
+	if masked {
+		if _, err := io.ReadFull(c.br, c.maskKey[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case OpContinuation, OpText, OpBinary:
+		if length > c.readLimit {
+			_ = c.writeClose(CloseMessageTooBig, "")
+			return &CloseError{Code: CloseMessageTooBig}
+		}
+		c.remaining = length
+		return nil
+	case OpClose, OpPing, OpPong:
+		if !fin || length > maxControlPayload {
+			return c.failProtocol("bad control frame")
+		}
+	default:
+		return c.failProtocol("unknown opcode")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		maskBytes(c.maskKey, 0, payload)
+	}
+	switch opcode {
+	case OpPing:
+		if c.onPing != nil {
+			c.onPing(payload)
+		}
+		return c.writeFrame(OpPong, payload)
+	case OpPong:
+		if c.onPong != nil {
+			c.onPong(payload)
+		}
+		return nil
+	}
+	// OpClose
+	code, reason := CloseNoStatusReceived, ""
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload))
+		reason = string(payload[2:])
+	}
+	if code == CloseNoStatusReceived {
+		_ = c.writeClose(CloseNormalClosure, "")
+	} else {
+		_ = c.writeClose(code, "")
+	}
+	if code == CloseNormalClosure || code == CloseGoingAway || code == CloseNoStatusReceived {
+		return io.EOF
+	}
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func (c *Conn) failProtocol(reason string) error {
+	_ = c.writeClose(CloseProtocolError, reason)
+	return fmt.Errorf("%w: %s", ErrProtocol, reason)
+}
+
+// Write Send p as a single binary frame
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(OpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Ping Send a ping control frame
+func (c *Conn) Ping(appData []byte) error {
+	if len(appData) > maxControlPayload {
+		return ErrProtocol
+	}
+	return c.writeFrame(OpPing, appData)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+	length := len(payload)
+	buf := make([]byte, 0, 14+length)
+	buf = append(buf, finBit|opcode)
+	var maskFlag byte
+	if c.isClient {
+		maskFlag = maskBit
+	}
+	switch {
+	case length <= 125:
+		buf = append(buf, maskFlag|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, maskFlag|126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		buf = append(buf, maskFlag|127)
+		buf = append(buf, ext[:]...)
+	}
+	if c.isClient {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, 0, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// writeClose Send a close frame once, later data frames are refused
+func (c *Conn) writeClose(code int, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	return c.writeFrameLocked(OpClose, payload)
+}
+
+// CloseWithCode Send a close frame with code and reason, then close the connection
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.writeClose(code, reason)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Close Close the connection with a normal closure
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormalClosure, "")
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// maskBytes Xor b with key starting at pos, returns the next position
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos & 3
+}
@@ -0,0 +1,265 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// bufConn A connection reading from r and writing into w
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	if c.r == nil {
+		return 0, io.EOF
+	}
+	return c.r.Read(p)
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *bufConn) Close() error {
+	return nil
+}
+
+func (c *bufConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// serverReading A server side connection reading the frames in raw
+func serverReading(raw []byte) (*Conn, *bufConn) {
+	conn := &bufConn{r: bytes.NewReader(raw)}
+	return NewConn(conn, nil, false), conn
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	for _, size := range []int{1, 125, 126, 0xffff, 0x10000, 200000} {
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = byte(i * 7)
+		}
+		for _, isClient := range []bool{true, false} {
+			out := &bufConn{}
+			if _, err := NewConn(out, nil, isClient).Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			in := NewConn(&bufConn{r: &out.w}, nil, !isClient)
+			in.SetReadLimit(int64(size))
+			got := make([]byte, size)
+			if _, err := io.ReadFull(in, got); err != nil {
+				t.Fatalf("size %d client %v: %v", size, isClient, err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("size %d client %v: payload differs", size, isClient)
+			}
+			if _, err := in.Read(got); err != io.EOF {
+				t.Errorf("size %d client %v: read after the last frame = %v, want EOF", size, isClient, err)
+			}
+		}
+	}
+}
+
+func TestConnMasking(t *testing.T) {
+	msg := []byte("masked payload")
+	client := &bufConn{}
+	if _, err := NewConn(client, nil, true).Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	frame := client.w.Bytes()
+	if frame[0] != finBit|OpBinary || frame[1] != maskBit|byte(len(msg)) {
+		t.Fatalf("client frame header %x", frame[:2])
+	}
+	var key [4]byte
+	copy(key[:], frame[2:6])
+	payload := append([]byte(nil), frame[6:]...)
+	maskBytes(key, 0, payload)
+	if !bytes.Equal(payload, msg) {
+		t.Errorf("client payload unmasked to %q", payload)
+	}
+
+	server := &bufConn{}
+	if _, err := NewConn(server, nil, false).Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{finBit | OpBinary, byte(len(msg))}, msg...)
+	if !bytes.Equal(server.w.Bytes(), want) {
+		t.Errorf("server frame %x, want %x", server.w.Bytes(), want)
+	}
+
+	// RFC 6455 section 5.7, a masked text frame of "Hello"
+	conn, _ := serverReading([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "Hello" {
+		t.Errorf("RFC example read %q, %v", got, err)
+	}
+}
+
+func TestMaskBytesInParts(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	whole := []byte("the mask continues across reads")
+	parts := append([]byte(nil), whole...)
+	maskBytes(key, 0, whole)
+	pos, start := 0, 0
+	for _, end := range []int{3, 4, 11, len(parts)} {
+		pos = maskBytes(key, pos, parts[start:end])
+		start = end
+	}
+	if !bytes.Equal(whole, parts) {
+		t.Errorf("masking in parts %x, at once %x", parts, whole)
+	}
+}
+
+func TestConnControlFrames(t *testing.T) {
+	client := &bufConn{}
+	clientConn := NewConn(client, nil, true)
+	if err := clientConn.Ping([]byte("goaway")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientConn.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientConn.Ping(make([]byte, maxControlPayload+1)); err != ErrProtocol {
+		t.Errorf("oversized ping = %v, want ErrProtocol", err)
+	}
+
+	server := &bufConn{r: &client.w}
+	serverConn := NewConn(server, nil, false)
+	var pinged []byte
+	serverConn.SetPingHandler(func(appData []byte) {
+		pinged = append([]byte(nil), appData...)
+	})
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(serverConn, got); err != nil || string(got) != "data" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if string(pinged) != "goaway" {
+		t.Errorf("ping handler got %q", pinged)
+	}
+
+	// The pong answers the ping with its data
+	var ponged []byte
+	reader := NewConn(&bufConn{r: &server.w}, nil, true)
+	reader.SetPongHandler(func(appData []byte) {
+		ponged = append([]byte(nil), appData...)
+	})
+	if _, err := reader.Read(got); err != io.EOF {
+		t.Fatalf("read after the pong = %v, want EOF", err)
+	}
+	if string(ponged) != "goaway" {
+		t.Errorf("pong handler got %q", ponged)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	tests := []struct {
+		code    int
+		reason  string
+		wantEOF bool
+	}{
+		{CloseNormalClosure, "", true},
+		{CloseGoingAway, "shutdown", true},
+		{ClosePolicyViolation, "bye", false},
+	}
+	for _, tt := range tests {
+		server := &bufConn{}
+		serverConn := NewConn(server, nil, false)
+		if err := serverConn.CloseWithCode(tt.code, tt.reason); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := serverConn.Write([]byte("late")); err == nil {
+			t.Errorf("close %d: write after close succeeded", tt.code)
+		}
+		client := &bufConn{r: &server.w}
+		_, err := NewConn(client, nil, true).Read(make([]byte, 1))
+		if tt.wantEOF {
+			if err != io.EOF {
+				t.Errorf("close %d: read = %v, want EOF", tt.code, err)
+			}
+		} else {
+			var closeErr *CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != tt.code || closeErr.Reason != tt.reason {
+				t.Errorf("close %d: read = %v", tt.code, err)
+			}
+		}
+		// The close is answered with the same code
+		answer := client.w.Bytes()
+		if len(answer) < 8 || answer[0] != finBit|OpClose || int(answer[6]^answer[2])<<8|int(answer[7]^answer[3]) != tt.code {
+			t.Errorf("close %d: answered with %x", tt.code, answer)
+		}
+	}
+}
+
+func TestConnMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		limit int64
+		want  func(err error) bool
+	}{
+		{"unmasked from client", []byte{0x82, 0x01, 'x'}, 0, isProtocolError},
+		{"reserved bits", []byte{0xc2, 0x81, 0, 0, 0, 0, 'x'}, 0, isProtocolError},
+		{"unknown opcode", []byte{0x83, 0x81, 0, 0, 0, 0, 'x'}, 0, isProtocolError},
+		{"fragmented ping", []byte{0x09, 0x80, 0, 0, 0, 0}, 0, isProtocolError},
+		{"oversized ping", append([]byte{0x89, 0xfe, 0x00, 0x7e, 0, 0, 0, 0}, make([]byte, 126)...), 0, isProtocolError},
+		{"negative length", []byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 1}, 0, isProtocolError},
+		{"over the read limit", []byte{0x82, 0x8b, 0, 0, 0, 0}, 10, isCloseCode(CloseMessageTooBig)},
+		{"truncated header", []byte{0x82}, 0, isErr(io.ErrUnexpectedEOF)},
+		{"truncated length", []byte{0x82, 0xfe, 0x01}, 0, isErr(io.ErrUnexpectedEOF)},
+		{"truncated payload", []byte{0x82, 0x85, 0, 0, 0, 0, 'a', 'b'}, 0, isErr(io.ErrUnexpectedEOF)},
+	}
+	for _, tt := range tests {
+		conn, raw := serverReading(tt.frame)
+		if tt.limit > 0 {
+			conn.SetReadLimit(tt.limit)
+		}
+		_, err := io.ReadAll(conn)
+		if !tt.want(err) {
+			t.Errorf("%s: read = %v", tt.name, err)
+		}
+		if isProtocolError(err) && (raw.w.Len() < 4 || raw.w.Bytes()[0] != finBit|OpClose ||
+			int(raw.w.Bytes()[2])<<8|int(raw.w.Bytes()[3]) != CloseProtocolError) {
+			t.Errorf("%s: protocol error answered with %x", tt.name, raw.w.Bytes())
+		}
+		// The error sticks
+		if _, again := conn.Read(make([]byte, 1)); again != err {
+			t.Errorf("%s: second read = %v, want %v", tt.name, again, err)
+		}
+	}
+}
+
+func isProtocolError(err error) bool {
+	return errors.Is(err, ErrProtocol)
+}
+
+func isCloseCode(code int) func(error) bool {
+	return func(err error) bool {
+		var closeErr *CloseError
+		return errors.As(err, &closeErr) && closeErr.Code == code
+	}
+}
+
+func isErr(want error) func(error) bool {
+	return func(err error) bool {
+		return err == want
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Version the only protocol version defined by RFC 6455
+const Version = "13"
+
+// keyGUID is appended to Sec-WebSocket-Key to produce Sec-WebSocket-Accept
+const keyGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrBadUpgrade = errors.New("websocket: missing or invalid upgrade headers")
+	ErrBadVersion = errors.New("websocket: unsupported Sec-WebSocket-Version")
+	ErrBadKey     = errors.New("websocket: missing or invalid Sec-WebSocket-Key")
+	ErrBadAccept  = errors.New("websocket: Sec-WebSocket-Accept mismatch")
+)
+
+// NewKey Generate a random Sec-WebSocket-Key
+func NewKey() (string, error) {
+	p := make([]byte, 16)
+	if _, err := rand.Read(p); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(p), nil
+}
+
+// AcceptKey Compute the Sec-WebSocket-Accept value for a key
+func AcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(keyGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// SetRequestHeaders Set the upgrade headers on a client request, returns the generated key
+func SetRequestHeaders(req *http.Request) (string, error) {
+	key, err := NewKey()
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", Version)
+	req.Header.Set("Sec-WebSocket-Key", key)
+	return key, nil
+}
+
+// CheckRequest Verify the upgrade headers of a server side request
+func CheckRequest(req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return ErrBadUpgrade
+	}
+	if !headerContainsToken(req.Header, "Connection", "upgrade") ||
+		!headerContainsToken(req.Header, "Upgrade", "websocket") {
+		return ErrBadUpgrade
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != Version {
+		return ErrBadVersion
+	}
+	key, err := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return ErrBadKey
+	}
+	return nil
+}
+
+// SetResponseHeaders Set the upgrade headers on a 101 response to req
+func SetResponseHeaders(resp *http.Response, req *http.Request) {
+	resp.Header.Set("Upgrade", "websocket")
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Sec-WebSocket-Accept", AcceptKey(req.Header.Get("Sec-WebSocket-Key")))
+}
+
+// CheckResponse Verify the 101 response of a client request sent with key
+func CheckResponse(resp *http.Response, key string) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		!headerContainsToken(resp.Header, "Upgrade", "websocket") {
+		return ErrBadUpgrade
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		return ErrBadAccept
+	}
+	return nil
+}
+
+// headerContainsToken Reports whether a comma separated header contains token, case-insensitively
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright 2022-present The Ztalab Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// RFC 6455 section 1.3
+	if got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("AcceptKey = %s", got)
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/secretLink", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := SetRequestHeaders(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: make(http.Header)}
+	SetResponseHeaders(resp, req)
+	if err = CheckResponse(resp, key); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := NewKey()
+	if err = CheckResponse(resp, other); err != ErrBadAccept {
+		t.Errorf("CheckResponse with another key = %v, want ErrBadAccept", err)
+	}
+}
+
+func TestCheckRequestMalformed(t *testing.T) {
+	valid := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "/secretLink", nil)
+		_, _ = SetRequestHeaders(req)
+		return req
+	}
+	tests := []struct {
+		name   string
+		modify func(req *http.Request)
+		want   error
+	}{
+		{"token list", func(req *http.Request) { req.Header.Set("Connection", "keep-alive, Upgrade") }, nil},
+		{"method", func(req *http.Request) { req.Method = http.MethodPost }, ErrBadUpgrade},
+		{"no connection upgrade", func(req *http.Request) { req.Header.Set("Connection", "keep-alive") }, ErrBadUpgrade},
+		{"no upgrade", func(req *http.Request) { req.Header.Del("Upgrade") }, ErrBadUpgrade},
+		{"version", func(req *http.Request) { req.Header.Set("Sec-WebSocket-Version", "8") }, ErrBadVersion},
+		{"no key", func(req *http.Request) { req.Header.Del("Sec-WebSocket-Key") }, ErrBadKey},
+		{"short key", func(req *http.Request) { req.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=") }, ErrBadKey},
+		{"not base64", func(req *http.Request) { req.Header.Set("Sec-WebSocket-Key", "!!!!") }, ErrBadKey},
+	}
+	for _, tt := range tests {
+		req := valid()
+		tt.modify(req)
+		if err := CheckRequest(req); err != tt.want {
+			t.Errorf("%s: CheckRequest = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckResponseMalformed(t *testing.T) {
+	key, _ := NewKey()
+	req, _ := http.NewRequest(http.MethodGet, "/secretLink", nil)
+	req.Header.Set("Sec-WebSocket-Key", key)
+	tests := []struct {
+		name   string
+		modify func(resp *http.Response)
+	}{
+		{"status", func(resp *http.Response) { resp.StatusCode = http.StatusOK }},
+		{"no connection upgrade", func(resp *http.Response) { resp.Header.Del("Connection") }},
+		{"no upgrade", func(resp *http.Response) { resp.Header.Set("Upgrade", "h2c") }},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: make(http.Header)}
+		SetResponseHeaders(resp, req)
+		tt.modify(resp)
+		if err := CheckResponse(resp, key); err != ErrBadUpgrade {
+			t.Errorf("%s: CheckResponse = %v, want ErrBadUpgrade", tt.name, err)
+		}
+	}
+}